@@ -0,0 +1,270 @@
+// Package client goRedisWeixin的Go客户端 支持RESP及HTTP接口
+// 获取的token和ticket在本地缓存至过期前RefreshBefore 请求失败时依次尝试其他服务地址
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	ProtocolResp = "resp"
+	ProtocolHttp = "http"
+
+	KindToken  = "token"
+	KindTicket = "ticket"
+)
+
+// ErrEmpty 服务端返回空值 通常为服务端请求微信接口失败
+var ErrEmpty = errors.New("empty value")
+
+// Value token或ticket及其过期时间
+type Value struct {
+	Value    string
+	ExpireAt time.Time
+}
+
+// Error 服务端返回的结构化错误 仅HTTP接口返回 ErrCode及ErrMsg为微信接口返回值
+type Error struct {
+	Code    string
+	Message string
+	ErrCode int
+	ErrMsg  string
+}
+
+func (e *Error) Error() string {
+	if e.ErrCode != 0 {
+		return fmt.Sprintf("%s: %s (errcode=%d errmsg=%s)", e.Code, e.Message, e.ErrCode, e.ErrMsg)
+	}
+	return fmt.Sprintf("%s: %s", e.Code, e.Message)
+}
+
+// permanent section不存在或配置错误时换用其他服务地址也不会成功
+func (e *Error) permanent() bool {
+	switch e.Code {
+	case "not_found", "invalid_type", "invalid_config":
+		return true
+	}
+	return false
+}
+
+type Options struct {
+	// Addrs 服务地址 resp为host:port http为http://host:port
+	Addrs []string
+	// Protocol resp(默认)或http
+	Protocol string
+	// Timeout 单次请求超时 默认3s
+	Timeout time.Duration
+	// RefreshBefore 本地缓存在过期前多久失效 默认60s
+	RefreshBefore time.Duration
+	// Attempts 每次获取最多尝试的次数 默认为地址数量
+	Attempts int
+}
+
+type transport interface {
+	fetch(ctx context.Context, addr, kind, section string, force bool) (*Value, error)
+	close() error
+}
+
+type call struct {
+	done  chan struct{}
+	value *Value
+	err   error
+}
+
+type Client struct {
+	opts      Options
+	transport transport
+	next      atomic.Int32
+
+	mu       sync.Mutex
+	cache    map[string]*Value
+	inflight map[string]*call
+}
+
+func New(opts Options) (*Client, error) {
+	if len(opts.Addrs) == 0 {
+		return nil, errors.New("weixin: no server address")
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = 3 * time.Second
+	}
+	if opts.RefreshBefore <= 0 {
+		opts.RefreshBefore = 60 * time.Second
+	}
+	if opts.Attempts <= 0 {
+		opts.Attempts = len(opts.Addrs)
+	}
+
+	c := &Client{
+		opts:     opts,
+		cache:    make(map[string]*Value),
+		inflight: make(map[string]*call),
+	}
+
+	switch opts.Protocol {
+	case "", ProtocolResp:
+		c.transport = newRespTransport(opts)
+	case ProtocolHttp:
+		c.transport = newHttpTransport(opts)
+	default:
+		return nil, fmt.Errorf("weixin: unsupported protocol %s", opts.Protocol)
+	}
+
+	return c, nil
+}
+
+func (c *Client) Close() error {
+	return c.transport.close()
+}
+
+// Token 获取access_token 本地缓存有效时直接返回
+func (c *Client) Token(ctx context.Context, section string) (*Value, error) {
+	return c.get(ctx, KindToken, section)
+}
+
+// Ticket 获取jsapi ticket 本地缓存有效时直接返回
+func (c *Client) Ticket(ctx context.Context, section string) (*Value, error) {
+	return c.get(ctx, KindTicket, section)
+}
+
+// RefreshToken 微信接口拒绝stale时调用 若服务端已持有其他值则直接使用 否则强制服务端刷新
+func (c *Client) RefreshToken(ctx context.Context, section, stale string) (*Value, error) {
+	return c.refresh(ctx, KindToken, section, stale)
+}
+
+// RefreshTicket 同RefreshToken
+func (c *Client) RefreshTicket(ctx context.Context, section, stale string) (*Value, error) {
+	return c.refresh(ctx, KindTicket, section, stale)
+}
+
+func (c *Client) cached(key string) *Value {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	v, ok := c.cache[key]
+	if !ok || time.Until(v.ExpireAt) <= c.opts.RefreshBefore {
+		return nil
+	}
+
+	return v
+}
+
+func (c *Client) get(ctx context.Context, kind, section string) (*Value, error) {
+	key := kind + ":" + section
+	if v := c.cached(key); v != nil {
+		return v, nil
+	}
+
+	return c.do(ctx, key, key, c.flightTimeout(1), func(ctx context.Context) (*Value, error) {
+		if v := c.cached(key); v != nil {
+			return v, nil
+		}
+		return c.fetch(ctx, kind, section, false)
+	})
+}
+
+func (c *Client) refresh(ctx context.Context, kind, section, stale string) (*Value, error) {
+	key := kind + ":" + section
+
+	//与普通获取分开合并 避免拿到正在进行的普通获取返回的stale
+	return c.do(ctx, "refresh:"+key, key, c.flightTimeout(2), func(ctx context.Context) (*Value, error) {
+		//同一进程内已有其他调用刷新过
+		if v := c.cached(key); v != nil && v.Value != stale {
+			return v, nil
+		}
+
+		//其他客户端已触发服务端刷新
+		v, err := c.fetch(ctx, kind, section, false)
+		if err == nil && v.Value != stale {
+			return v, nil
+		}
+
+		var we *Error
+		if errors.As(err, &we) && we.permanent() {
+			return nil, err
+		}
+
+		return c.fetch(ctx, kind, section, true)
+	})
+}
+
+// flightTimeout 合并请求的总超时 rounds为依次尝试所有地址的轮数
+func (c *Client) flightTimeout(rounds int) time.Duration {
+	return c.opts.Timeout * time.Duration(c.opts.Attempts*rounds)
+}
+
+// do 同一flight同时只有一个请求 其他调用等待并共享结果 成功后写入key的本地缓存
+// 请求使用脱离调用方的ctx及timeout 调用方取消时只结束自身的等待 不影响其他等待者
+func (c *Client) do(ctx context.Context, flight, key string, timeout time.Duration, fn func(ctx context.Context) (*Value, error)) (*Value, error) {
+	c.mu.Lock()
+	cl, ok := c.inflight[flight]
+	if !ok {
+		cl = &call{done: make(chan struct{})}
+		c.inflight[flight] = cl
+		go c.run(context.WithoutCancel(ctx), flight, key, timeout, cl, fn)
+	}
+	c.mu.Unlock()
+
+	select {
+	case <-cl.done:
+		return cl.value, cl.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Client) run(ctx context.Context, flight, key string, timeout time.Duration, cl *call, fn func(ctx context.Context) (*Value, error)) {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	cl.value, cl.err = fn(ctx)
+
+	c.mu.Lock()
+	delete(c.inflight, flight)
+	if cl.err == nil {
+		c.cache[key] = cl.value
+	}
+	c.mu.Unlock()
+	close(cl.done)
+}
+
+// fetch 从上次成功的地址开始依次尝试
+func (c *Client) fetch(ctx context.Context, kind, section string, force bool) (*Value, error) {
+	start := int(c.next.Load())
+
+	var lastErr error
+	for i := 0; i < c.opts.Attempts; i++ {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+
+		n := (start + i) % len(c.opts.Addrs)
+
+		reqCtx, cancel := context.WithTimeout(ctx, c.opts.Timeout)
+		v, err := c.transport.fetch(reqCtx, c.opts.Addrs[n], kind, section, force)
+		cancel()
+
+		if err == nil {
+			c.next.Store(int32(n))
+			return v, nil
+		}
+
+		var we *Error
+		replied := errors.As(err, &we) || errors.Is(err, ErrEmpty)
+		if replied && we != nil && we.permanent() {
+			return nil, fmt.Errorf("weixin: %s: %w", c.opts.Addrs[n], err)
+		}
+
+		//优先返回服务端的回复 而不是其他地址的连接错误
+		if lastErr == nil || replied {
+			lastErr = fmt.Errorf("weixin: %s: %w", c.opts.Addrs[n], err)
+		}
+	}
+
+	return nil, lastErr
+}
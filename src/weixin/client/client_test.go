@@ -0,0 +1,213 @@
+package client
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeTransport 模拟服务端 force时生成新值 down中的地址不可达
+type fakeTransport struct {
+	mu     sync.Mutex
+	down   map[string]error
+	delay  time.Duration
+	seq    int
+	calls  map[string]int
+	forced int
+}
+
+func newFakeTransport() *fakeTransport {
+	return &fakeTransport{down: make(map[string]error), calls: make(map[string]int)}
+}
+
+func (t *fakeTransport) fetch(ctx context.Context, addr, kind, section string, force bool) (*Value, error) {
+	t.mu.Lock()
+	t.calls[addr]++
+	err := t.down[addr]
+	if err == nil && force {
+		t.seq++
+		t.forced++
+	}
+	value := fmt.Sprintf("%s_%s_%d", kind, section, t.seq)
+	t.mu.Unlock()
+
+	if err != nil {
+		return nil, err
+	}
+
+	select {
+	case <-time.After(t.delay):
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+
+	return &Value{Value: value, ExpireAt: time.Now().Add(2 * time.Hour)}, nil
+}
+
+func (t *fakeTransport) close() error {
+	return nil
+}
+
+// rotate 模拟其他客户端触发了服务端刷新
+func (t *fakeTransport) rotate() {
+	t.mu.Lock()
+	t.seq++
+	t.mu.Unlock()
+}
+
+func (t *fakeTransport) stats() (map[string]int, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	calls := make(map[string]int)
+	for k, v := range t.calls {
+		calls[k] = v
+	}
+	return calls, t.forced
+}
+
+func newTestClient(t *testing.T, addrs ...string) (*Client, *fakeTransport) {
+	t.Helper()
+
+	c, err := New(Options{Addrs: addrs, Timeout: time.Second})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ft := newFakeTransport()
+	c.transport = ft
+
+	return c, ft
+}
+
+func TestFailover(t *testing.T) {
+	c, ft := newTestClient(t, "a", "b")
+	ft.down["a"] = errors.New("connection refused")
+
+	v, err := c.Token(context.Background(), "gzh")
+	if err != nil || v.Value != "token_gzh_0" {
+		t.Fatalf("token = %v %v", v, err)
+	}
+
+	//之后从上次成功的地址开始
+	if _, err := c.Ticket(context.Background(), "gzh"); err != nil {
+		t.Fatal(err)
+	}
+	if calls, _ := ft.stats(); calls["a"] != 1 || calls["b"] != 2 {
+		t.Fatalf("calls = %v", calls)
+	}
+
+	ft.down["b"] = errors.New("connection refused")
+	if _, err := c.RefreshToken(context.Background(), "gzh", v.Value); err == nil {
+		t.Fatal("refresh should fail when all servers down")
+	}
+}
+
+func TestFailoverPermanent(t *testing.T) {
+	c, ft := newTestClient(t, "a", "b")
+	ft.down["a"] = &Error{Code: "not_found", Message: "not found"}
+
+	var we *Error
+	if _, err := c.Token(context.Background(), "noid"); !errors.As(err, &we) || we.Code != "not_found" {
+		t.Fatalf("err = %v", err)
+	}
+	if calls, _ := ft.stats(); calls["b"] != 0 {
+		t.Fatalf("permanent error should not fail over: %v", calls)
+	}
+}
+
+func TestSingleflight(t *testing.T) {
+	c, ft := newTestClient(t, "a")
+	ft.delay = 100 * time.Millisecond
+
+	var wg sync.WaitGroup
+	values := make([]string, 10)
+	for i := range values {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if v, err := c.Token(context.Background(), "gzh"); err == nil {
+				values[i] = v.Value
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	for _, v := range values {
+		if v != "token_gzh_0" {
+			t.Fatalf("values = %v", values)
+		}
+	}
+	if calls, _ := ft.stats(); calls["a"] != 1 {
+		t.Fatalf("calls = %v", calls)
+	}
+}
+
+// 发起请求的调用方取消后 其他等待者仍获得结果
+func TestSingleflightCallerCancel(t *testing.T) {
+	c, ft := newTestClient(t, "a")
+	ft.delay = 200 * time.Millisecond
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	errs := make(chan error, 1)
+	go func() {
+		_, err := c.Token(ctx, "gzh")
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	v, err := c.Token(context.Background(), "gzh")
+	if err != nil || v.Value != "token_gzh_0" {
+		t.Fatalf("waiter token = %v %v", v, err)
+	}
+	if err := <-errs; !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("canceled caller err = %v", err)
+	}
+	if calls, _ := ft.stats(); calls["a"] != 1 {
+		t.Fatalf("calls = %v", calls)
+	}
+}
+
+func TestRefreshStale(t *testing.T) {
+	c, ft := newTestClient(t, "a")
+
+	v, err := c.Token(context.Background(), "gzh")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//服务端已持有其他值时不强制刷新
+	ft.rotate()
+	fresh, err := c.RefreshToken(context.Background(), "gzh", v.Value)
+	if err != nil || fresh.Value != "token_gzh_1" {
+		t.Fatalf("refresh = %v %v", fresh, err)
+	}
+	if _, forced := ft.stats(); forced != 0 {
+		t.Fatalf("forced = %d", forced)
+	}
+
+	//服务端仍返回stale时强制刷新 并发调用只刷新一次
+	ft.delay = 50 * time.Millisecond
+	var wg sync.WaitGroup
+	for i := 0; i < 5; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if v, err := c.RefreshToken(context.Background(), "gzh", fresh.Value); err != nil || v.Value != "token_gzh_2" {
+				t.Errorf("forced refresh = %v %v", v, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if _, forced := ft.stats(); forced != 1 {
+		t.Fatalf("forced = %d", forced)
+	}
+	if v, _ := c.Token(context.Background(), "gzh"); v.Value != "token_gzh_2" {
+		t.Fatalf("cached token = %v", v)
+	}
+}
@@ -0,0 +1,78 @@
+package client
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// httpTransport 使用/v2接口 GET读取 POST强制刷新
+type httpTransport struct {
+	client *http.Client
+}
+
+type httpEnvelope struct {
+	Data *struct {
+		Value    string `json:"value"`
+		ExpireAt int64  `json:"expireAt"`
+	} `json:"data"`
+	Error *struct {
+		Code    string `json:"code"`
+		Message string `json:"message"`
+		ErrCode int    `json:"errcode"`
+		ErrMsg  string `json:"errmsg"`
+	} `json:"error"`
+}
+
+func newHttpTransport(opts Options) *httpTransport {
+	return &httpTransport{
+		client: &http.Client{Timeout: opts.Timeout},
+	}
+}
+
+func (t *httpTransport) fetch(ctx context.Context, addr, kind, section string, force bool) (*Value, error) {
+	method := http.MethodGet
+	if force {
+		method = http.MethodPost
+	}
+
+	u := strings.TrimRight(addr, "/") + "/v2/" + kind + "/" + url.PathEscape(section)
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := t.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	var envelope httpEnvelope
+	if err := json.NewDecoder(res.Body).Decode(&envelope); err != nil {
+		return nil, fmt.Errorf("invalid response status %d: %w", res.StatusCode, err)
+	}
+
+	if envelope.Error != nil {
+		return nil, &Error{
+			Code:    envelope.Error.Code,
+			Message: envelope.Error.Message,
+			ErrCode: envelope.Error.ErrCode,
+			ErrMsg:  envelope.Error.ErrMsg,
+		}
+	}
+	if envelope.Data == nil || len(envelope.Data.Value) == 0 {
+		return nil, ErrEmpty
+	}
+
+	return &Value{Value: envelope.Data.Value, ExpireAt: time.Unix(envelope.Data.ExpireAt, 0)}, nil
+}
+
+func (t *httpTransport) close() error {
+	t.client.CloseIdleConnections()
+	return nil
+}
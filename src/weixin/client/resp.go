@@ -0,0 +1,84 @@
+package client
+
+import (
+	"context"
+	"fmt"
+	"github.com/redis/go-redis/v9"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// respTransport 使用ztoken,zticket命令 每个地址一个连接池
+type respTransport struct {
+	opts    Options
+	mu      sync.Mutex
+	clients map[string]*redis.Client
+}
+
+func newRespTransport(opts Options) *respTransport {
+	return &respTransport{
+		opts:    opts,
+		clients: make(map[string]*redis.Client),
+	}
+}
+
+func (t *respTransport) client(addr string) *redis.Client {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	rc, ok := t.clients[addr]
+	if !ok {
+		rc = redis.NewClient(&redis.Options{
+			Addr:         addr,
+			Protocol:     2,
+			DialTimeout:  t.opts.Timeout,
+			ReadTimeout:  t.opts.Timeout,
+			WriteTimeout: t.opts.Timeout,
+			MaxRetries:   -1,
+		})
+		t.clients[addr] = rc
+	}
+
+	return rc
+}
+
+func (t *respTransport) fetch(ctx context.Context, addr, kind, section string, force bool) (*Value, error) {
+	args := []interface{}{"z" + kind, section}
+	if force {
+		args = append(args, "1")
+	}
+
+	res, err := t.client(addr).Do(ctx, args...).StringSlice()
+	if err != nil {
+		return nil, err
+	}
+	if len(res) != 2 {
+		return nil, fmt.Errorf("unexpected reply length %d", len(res))
+	}
+	if len(res[0]) == 0 {
+		return nil, ErrEmpty
+	}
+
+	expireAt, err := strconv.ParseInt(res[1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid expireAt %q", res[1])
+	}
+
+	return &Value{Value: res[0], ExpireAt: time.Unix(expireAt, 0)}, nil
+}
+
+func (t *respTransport) close() error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var err error
+	for addr, rc := range t.clients {
+		if e := rc.Close(); e != nil {
+			err = e
+		}
+		delete(t.clients, addr)
+	}
+
+	return err
+}
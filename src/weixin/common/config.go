@@ -2,17 +2,82 @@ package common
 
 import (
 	"errors"
+	"fmt"
 	"gopkg.in/ini.v1"
+	"io"
+	"os"
+	"sort"
 )
 
 type config struct {
-	WebAddress   string `ini:"web"`
-	RedisAddress string `ini:"redis"`
-	DataFile     string `ini:"data_file"`
-	IniCfg       *ini.File
+	WebAddress           string   `ini:"web"`
+	RedisAddress         string   `ini:"redis"`
+	GrpcAddress          string   `ini:"grpc"`
+	DataFile             string   `ini:"data_file"`
+	DataKey              string   `ini:"data_key"`
+	DataBackups          int      `ini:"data_backups"`
+	Storage              string   `ini:"storage"`
+	StoragePath          string   `ini:"storage_path"`
+	StorageRedis         string   `ini:"storage_redis"`
+	StorageRedisPassword string   `ini:"storage_redis_password"`
+	StorageRedisDB       int      `ini:"storage_redis_db"`
+	StoragePrefix        string   `ini:"storage_prefix"`
+	Cluster              bool     `ini:"cluster"`
+	ClusterLease         int      `ini:"cluster_lease"`
+	InstanceId           string   `ini:"instance_id"`
+	AdminAddress         string   `ini:"admin"`
+	CriticalSections     []string `ini:"critical_sections" delim:","`
+	LogLevel             string   `ini:"log_level"`
+	LogFormat            string   `ini:"log_format"`
+	LogFile              string   `ini:"log_file"`
+	LogMaxSize           int      `ini:"log_max_size"`
+	LogMaxAge            int      `ini:"log_max_age"`
+	LogMaxBackups        int      `ini:"log_max_backups"`
+	LogCompress          bool     `ini:"log_compress"`
+	LogRotate            string   `ini:"log_rotate"`
+	AccessLog            string   `ini:"access_log"`
+	Mode                 string   `ini:"mode"`
+	MockExpiresIn        int      `ini:"mock_expires_in"`
+	MockErrCode          int      `ini:"mock_errcode"`
+	MockErrMsg           string   `ini:"mock_errmsg"`
+	UpstreamConnTimeout  int      `ini:"upstream_connect_timeout"`
+	UpstreamTimeout      int      `ini:"upstream_timeout"`
+	UpstreamMaxIdle      int      `ini:"upstream_max_idle_per_host"`
+	UpstreamIdleTimeout  int      `ini:"upstream_idle_timeout"`
+	UpstreamHttp2        bool     `ini:"upstream_http2"`
+	UpstreamDeadline     int      `ini:"upstream_deadline"`
+	RetryAttempts        int      `ini:"retry_attempts"`
+	RetryBackoff         int      `ini:"retry_backoff"`
+	RetryMaxBackoff      int      `ini:"retry_max_backoff"`
+	RetryErrCodes        []int    `ini:"retry_errcodes" delim:","`
+	BreakerThreshold     int      `ini:"breaker_threshold"`
+	BreakerCooldown      int      `ini:"breaker_cooldown"`
+	HttpProxy            string   `ini:"http_proxy"`
+	Socks5Proxy          string   `ini:"socks5_proxy"`
+	BindAddress          string   `ini:"bind_address"`
+	IniCfg               *ini.File
+	secrets              map[string]string
 }
 
-var Config = new(config)
+var Config = &config{
+	DataBackups:   3,
+	StoragePrefix: "weixin:",
+	ClusterLease:  30,
+	LogMaxSize:    100,
+
+	UpstreamConnTimeout: 60,
+	UpstreamTimeout:     60,
+	UpstreamMaxIdle:     4,
+	UpstreamIdleTimeout: 90,
+	UpstreamHttp2:       true,
+	UpstreamDeadline:    15,
+	RetryAttempts:       3,
+	RetryBackoff:        200,
+	RetryMaxBackoff:     2000,
+	RetryErrCodes:       []int{-1, 45011},
+	BreakerThreshold:    5,
+	BreakerCooldown:     30,
+}
 
 func ParseConfig(configPath string) (*config, error) {
 	if len(configPath) == 0 {
@@ -32,13 +97,165 @@ func ParseConfig(configPath string) (*config, error) {
 		return nil, err
 	}
 
+	if err = checkLogRotate(Config.LogRotate); err != nil {
+		return nil, err
+	}
+
+	var logOutput io.Writer = os.Stdout
+	if len(Config.LogFile) > 0 {
+		logOutput = newLogFile(Config.LogFile, Config.LogMaxSize, Config.LogMaxAge, Config.LogMaxBackups, Config.LogCompress, Config.LogRotate)
+	}
+
+	if err = SetupLogger(Config.LogFormat, Config.LogLevel, logOutput); err != nil {
+		return nil, err
+	}
+
+	switch Config.AccessLog {
+	case "":
+		SetupAccessLogger(Config.LogFormat, nil)
+	case "off":
+		SetupAccessLogger(Config.LogFormat, io.Discard)
+	case "stdout":
+		SetupAccessLogger(Config.LogFormat, os.Stdout)
+	default:
+		SetupAccessLogger(Config.LogFormat, newLogFile(Config.AccessLog, Config.LogMaxSize, Config.LogMaxAge, Config.LogMaxBackups, Config.LogCompress, Config.LogRotate))
+	}
+
 	if len(Config.WebAddress) == 0 || len(Config.RedisAddress) == 0 {
 		return nil, errors.New("error config address")
 	}
 
+	//data_key同样支持env:,file:,exec:
+	Config.DataKey, err = ResolveSecret(Config.DataKey)
+	if err != nil {
+		return nil, fmt.Errorf("resolve data_key fail %v", err)
+	}
+	RegisterSecret(Config.DataKey)
+
+	Config.StorageRedisPassword, err = ResolveSecret(Config.StorageRedisPassword)
+	if err != nil {
+		return nil, fmt.Errorf("resolve storage_redis_password fail %v", err)
+	}
+	RegisterSecret(Config.StorageRedisPassword)
+
+	if Config.ClusterLease <= 0 {
+		return nil, errors.New("error config cluster_lease")
+	}
+
+	if Config.UpstreamConnTimeout <= 0 || Config.UpstreamTimeout <= 0 || Config.UpstreamIdleTimeout <= 0 || Config.UpstreamMaxIdle < 0 {
+		return nil, errors.New("error config upstream")
+	}
+
+	if Config.UpstreamDeadline < 0 || Config.RetryAttempts <= 0 || Config.RetryBackoff < 0 || Config.RetryMaxBackoff < 0 {
+		return nil, errors.New("error config retry")
+	}
+
+	if Config.BreakerThreshold < 0 || Config.BreakerCooldown <= 0 {
+		return nil, errors.New("error config breaker")
+	}
+
+	if Config.Mode != "" && Config.Mode != ModeMock {
+		return nil, fmt.Errorf("error config mode %s", Config.Mode)
+	}
+
+	secrets, err := resolveSecrets(cfg)
+	if err != nil {
+		return nil, err
+	}
+
 	Config.IniCfg = cfg
+	Config.secrets = secrets
 
-	Logger.Printf("load server config %+v", Config)
+	Logger.Info("load server config",
+		"web", Config.WebAddress,
+		"redis", Config.RedisAddress,
+		"data_file", Config.DataFile,
+		"storage", Config.Storage,
+		"cluster", Config.Cluster,
+		"encrypted", len(Config.DataKey) > 0,
+		"mode", Config.Mode,
+		"accounts", len(secrets))
 
 	return Config, nil
 }
+
+// Accounts 返回配置了app_secret或mode=mock且配置了app_id的section名称
+func (c *config) Accounts() []string {
+	names := make([]string, 0, len(c.secrets))
+	for name := range c.secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	return names
+}
+
+// IsAccount 判断section是否为已配置的公众号
+func (c *config) IsAccount(name string) bool {
+	_, ok := c.secrets[name]
+	return ok
+}
+
+// AppId 返回section对应的app_id
+func (c *config) AppId(name string) string {
+	section, err := c.IniCfg.GetSection(name)
+	if err != nil {
+		return ""
+	}
+
+	key, err := section.GetKey("app_id")
+	if err != nil {
+		return ""
+	}
+
+	return key.String()
+}
+
+// AppSecret 返回section对应已解析的app_secret
+func (c *config) AppSecret(name string) string {
+	return c.secrets[name]
+}
+
+// SectionMode 返回section的mode 未配置时使用全局mode
+func (c *config) SectionMode(name string) string {
+	return sectionMode(c.IniCfg.Section(name))
+}
+
+// SectionValue 返回section中key的值 section未配置该key时返回全局值
+func (c *config) SectionValue(name, key, global string) string {
+	section := c.IniCfg.Section(name)
+	if section.HasKey(key) {
+		return section.Key(key).String()
+	}
+	return global
+}
+
+func sectionMode(section *ini.Section) string {
+	if section.HasKey("mode") {
+		return section.Key("mode").String()
+	}
+	return Config.Mode
+}
+
+func resolveSecrets(cfg *ini.File) (map[string]string, error) {
+	secrets := make(map[string]string)
+	for _, section := range cfg.Sections() {
+		if !section.HasKey("app_secret") {
+			//mock模式不请求微信接口 无需app_secret
+			if section.HasKey("app_id") && sectionMode(section) == ModeMock {
+				secrets[section.Name()] = ""
+			}
+			continue
+		}
+
+		secret, err := ResolveSecret(section.Key("app_secret").String())
+		if err != nil {
+			return nil, fmt.Errorf("resolve app_secret of %s fail %v", section.Name(), err)
+		}
+
+		secrets[section.Name()] = secret
+		RegisterSecret(secret)
+	}
+
+	return secrets, nil
+}
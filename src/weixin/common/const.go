@@ -1,3 +1,6 @@
 package common
 
 const VERSION = "1.4.1"
+
+// ModeMock 不请求微信接口 生成模拟的token和ticket
+const ModeMock = "mock"
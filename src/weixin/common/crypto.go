@@ -0,0 +1,71 @@
+package common
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+)
+
+// 加密数据文件头
+var encryptedMagic = []byte("WXENC1")
+
+// IsEncrypted 判断数据是否为EncryptData输出的密文
+func IsEncrypted(data []byte) bool {
+	return bytes.HasPrefix(data, encryptedMagic)
+}
+
+// EncryptData 使用AES-GCM加密 key经sha256派生为256位密钥
+func EncryptData(key string, plain []byte) ([]byte, error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return nil, err
+	}
+
+	out := make([]byte, 0, len(encryptedMagic)+len(nonce)+len(plain)+gcm.Overhead())
+	out = append(out, encryptedMagic...)
+	out = append(out, nonce...)
+
+	return gcm.Seal(out, nonce, plain, encryptedMagic), nil
+}
+
+// DecryptData 解密EncryptData输出的密文
+func DecryptData(key string, data []byte) ([]byte, error) {
+	if !IsEncrypted(data) {
+		return nil, errors.New("data not encrypted")
+	}
+
+	gcm, err := newGCM(key)
+	if err != nil {
+		return nil, err
+	}
+
+	data = data[len(encryptedMagic):]
+	if len(data) < gcm.NonceSize() {
+		return nil, errors.New("encrypted data too short")
+	}
+
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], encryptedMagic)
+}
+
+func newGCM(key string) (cipher.AEAD, error) {
+	if len(key) == 0 {
+		return nil, errors.New("empty data key")
+	}
+
+	sum := sha256.Sum256([]byte(key))
+	block, err := aes.NewCipher(sum[:])
+	if err != nil {
+		return nil, err
+	}
+
+	return cipher.NewGCM(block)
+}
@@ -0,0 +1,63 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestEncryptDecrypt(t *testing.T) {
+	plain := []byte(`{"token":{"wx123":{"value":"TOKEN"}}}`)
+
+	data, err := EncryptData("key", plain)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsEncrypted(data) || bytes.Contains(data, plain) {
+		t.Fatalf("encrypted data = %q", data)
+	}
+
+	again, _ := EncryptData("key", plain)
+	if bytes.Equal(data, again) {
+		t.Fatal("nonce should differ between encryptions")
+	}
+
+	got, err := DecryptData("key", data)
+	if err != nil || !bytes.Equal(got, plain) {
+		t.Fatalf("decrypt = %q %v", got, err)
+	}
+}
+
+func TestDecryptErrors(t *testing.T) {
+	data, err := EncryptData("key", []byte("plain"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tampered := append([]byte{}, data...)
+	tampered[len(tampered)-1] ^= 0xff
+
+	tests := []struct {
+		name string
+		key  string
+		data []byte
+	}{
+		{name: "wrong key", key: "other", data: data},
+		{name: "empty key", key: "", data: data},
+		{name: "missing header", key: "key", data: data[len(encryptedMagic):]},
+		{name: "plain text", key: "key", data: []byte(`{"token":{}}`)},
+		{name: "too short", key: "key", data: encryptedMagic},
+		{name: "tampered", key: "key", data: tampered},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got, err := DecryptData(tt.key, tt.data); err == nil {
+				t.Fatalf("decrypt = %q, want error", got)
+			}
+		})
+	}
+
+	if _, err := EncryptData("", []byte("plain")); err == nil {
+		t.Fatal("encrypt with empty key should fail")
+	}
+}
@@ -0,0 +1,83 @@
+package common
+
+import (
+	"fmt"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"os"
+	"time"
+)
+
+// newLogFile 按大小及天数切割日志文件 rotate为daily,hourly时同时按时间切割
+// maxSize单位MB maxAge单位天 maxBackups为保留份数 0表示不限制
+func newLogFile(path string, maxSize, maxAge, maxBackups int, compress bool, rotate string) *lumberjack.Logger {
+	logFile := &lumberjack.Logger{
+		Filename:   path,
+		MaxSize:    maxSize,
+		MaxAge:     maxAge,
+		MaxBackups: maxBackups,
+		LocalTime:  true,
+		Compress:   compress,
+	}
+
+	ch := make(chan os.Signal, 1)
+	if notifyReopen(ch) {
+		go func() {
+			for range ch {
+				//关闭后下次写入时重新打开 配合外部logrotate移动文件
+				if err := logFile.Close(); err != nil {
+					Logger.Error("reopen log file fail", "err", err)
+					continue
+				}
+				Logger.Info("reopen log file", "path", path)
+			}
+		}()
+	}
+
+	if next := rotateSchedule(rotate); next != nil {
+		go rotateLogFile(logFile, next, nil)
+	}
+
+	return logFile
+}
+
+// checkLogRotate log_rotate可选daily,hourly 为空时只按大小切割
+func checkLogRotate(rotate string) error {
+	switch rotate {
+	case "", "daily", "hourly":
+		return nil
+	}
+	return fmt.Errorf("error log_rotate %s", rotate)
+}
+
+// rotateSchedule 返回下次按时间切割的时刻 按本地时间的整点或零点切割
+func rotateSchedule(rotate string) func(now time.Time) time.Time {
+	switch rotate {
+	case "daily":
+		return func(now time.Time) time.Time {
+			y, m, d := now.Date()
+			return time.Date(y, m, d+1, 0, 0, 0, 0, now.Location())
+		}
+	case "hourly":
+		return func(now time.Time) time.Time {
+			return now.Truncate(time.Hour).Add(time.Hour)
+		}
+	}
+	return nil
+}
+
+// rotateLogFile 到达切割时刻时调用Rotate 直到stop关闭
+func rotateLogFile(logFile *lumberjack.Logger, next func(now time.Time) time.Time, stop <-chan struct{}) {
+	for {
+		timer := time.NewTimer(time.Until(next(time.Now())))
+		select {
+		case <-timer.C:
+		case <-stop:
+			timer.Stop()
+			return
+		}
+
+		if err := logFile.Rotate(); err != nil {
+			Logger.Error("rotate log file fail", "path", logFile.Filename, "err", err)
+		}
+	}
+}
@@ -0,0 +1,67 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRotateSchedule(t *testing.T) {
+	now := time.Date(2024, 2, 29, 23, 15, 30, 0, time.Local)
+
+	if next := rotateSchedule("daily")(now); !next.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("daily next = %v", next)
+	}
+	if next := rotateSchedule("hourly")(now); !next.Equal(time.Date(2024, 3, 1, 0, 0, 0, 0, time.Local)) {
+		t.Fatalf("hourly next = %v", next)
+	}
+	if next := rotateSchedule("hourly")(now.Add(-time.Hour)); !next.Equal(time.Date(2024, 2, 29, 23, 0, 0, 0, time.Local)) {
+		t.Fatalf("hourly next = %v", next)
+	}
+	if rotateSchedule("") != nil {
+		t.Fatal("no schedule without log_rotate")
+	}
+
+	if err := checkLogRotate("weekly"); err == nil {
+		t.Fatal("unknown log_rotate should fail")
+	}
+}
+
+// 到达切割时刻后当前文件改名为带时间的备份 之后写入新文件
+func TestRotateLogFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "server.log")
+	logFile := newLogFile(path, 100, 0, 0, false, "")
+	defer logFile.Close()
+
+	if _, err := logFile.Write([]byte("before\n")); err != nil {
+		t.Fatal(err)
+	}
+	stop, done := make(chan struct{}), make(chan struct{})
+	defer func() {
+		close(stop)
+		<-done
+	}()
+	go func() {
+		defer close(done)
+		rotateLogFile(logFile, func(now time.Time) time.Time {
+			return now.Add(50 * time.Millisecond)
+		}, stop)
+	}()
+
+	for i := 0; i < 100; i++ {
+		entries, _ := os.ReadDir(dir)
+		if len(entries) >= 2 {
+			if _, err := logFile.Write([]byte("after\n")); err != nil {
+				t.Fatal(err)
+			}
+			if content, _ := os.ReadFile(path); string(content) != "after\n" {
+				t.Fatalf("current log = %q", content)
+			}
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	t.Fatal("log file not rotated")
+}
@@ -1,27 +1,253 @@
 package common
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"net/url"
 	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
 )
 
-var Logger = log.New(os.Stdout, "", log.Ldate|log.Ltime|log.Lshortfile)
+var logLevel = new(slog.LevelVar)
 
+var Logger = slog.New(newLogHandler(os.Stdout, "text", true))
+
+// AccessLogger RESP及HTTP访问日志
+var AccessLogger = Logger
+
+// SetupLogger 按配置重建Logger format为text或json level为debug,info,warn,error
+func SetupLogger(format, level string, w io.Writer) error {
+	if len(level) > 0 {
+		var l slog.Level
+		if err := l.UnmarshalText([]byte(level)); err != nil {
+			return fmt.Errorf("error log_level %s", level)
+		}
+		logLevel.Set(l)
+	}
+
+	switch format {
+	case "", "text", "json":
+	default:
+		return fmt.Errorf("error log_format %s", format)
+	}
+
+	Logger = slog.New(newLogHandler(w, format, true))
+	slog.SetDefault(Logger)
+
+	return nil
+}
+
+// SetupAccessLogger w为nil时访问日志写入Logger
+func SetupAccessLogger(format string, w io.Writer) {
+	if w == nil {
+		AccessLogger = Logger.With("component", "access")
+		return
+	}
+
+	AccessLogger = slog.New(newLogHandler(w, format, false))
+}
+
+func newLogHandler(w io.Writer, format string, addSource bool) slog.Handler {
+	opts := &slog.HandlerOptions{
+		AddSource: addSource,
+		Level:     logLevel,
+		ReplaceAttr: func(groups []string, a slog.Attr) slog.Attr {
+			//与之前log.Lshortfile一致 只输出文件名
+			if a.Key == slog.SourceKey {
+				if source, ok := a.Value.Any().(*slog.Source); ok {
+					return slog.String(slog.SourceKey, fmt.Sprintf("%s:%d", filepath.Base(source.File), source.Line))
+				}
+			}
+			return a
+		},
+	}
+
+	if format == "json" {
+		return &maskHandler{slog.NewJSONHandler(w, opts)}
+	}
+
+	return &maskHandler{slog.NewTextHandler(w, opts)}
+}
+
+// Mask 返回敏感值的短指纹 可用于比对而不泄露原值
+func Mask(v string) string {
+	if len(v) == 0 {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(v))
+	return "fp:" + hex.EncodeToString(sum[:4])
+}
+
+// Secret 作为日志属性时只输出指纹
+type Secret string
+
+func (s Secret) LogValue() slog.Value {
+	return slog.StringValue(Mask(string(s)))
+}
+
+const maxSecrets = 4096
+
+var secretRegistry = struct {
+	sync.RWMutex
+	values   map[string]bool
+	order    []string
+	replacer *strings.Replacer
+}{values: make(map[string]bool)}
+
+// RegisterSecret 登记敏感值 此后出现在日志中的该值都会被替换为指纹
+func RegisterSecret(v string) {
+	if len(v) < 6 {
+		return
+	}
+
+	secretRegistry.Lock()
+	defer secretRegistry.Unlock()
+
+	if secretRegistry.values[v] {
+		return
+	}
+
+	secretRegistry.values[v] = true
+	secretRegistry.order = append(secretRegistry.order, v)
+	if len(secretRegistry.order) > maxSecrets {
+		delete(secretRegistry.values, secretRegistry.order[0])
+		secretRegistry.order = secretRegistry.order[1:]
+	}
+
+	pairs := make([]string, 0, len(secretRegistry.order)*2)
+	for _, s := range secretRegistry.order {
+		pairs = append(pairs, s, Mask(s))
+	}
+	secretRegistry.replacer = strings.NewReplacer(pairs...)
+}
+
+// 接口地址中的凭证参数
+var secretParamPattern = regexp.MustCompile(`((?:access_token|secret|corpsecret)=)([^&\s"]+)`)
+
+// Scrub 替换字符串中已登记的敏感值及url中的凭证参数
+func Scrub(s string) string {
+	secretRegistry.RLock()
+	replacer := secretRegistry.replacer
+	secretRegistry.RUnlock()
+
+	if replacer != nil {
+		s = replacer.Replace(s)
+	}
+
+	return secretParamPattern.ReplaceAllStringFunc(s, func(m string) string {
+		parts := secretParamPattern.FindStringSubmatch(m)
+		if strings.HasPrefix(parts[2], "fp:") {
+			return m
+		}
+		return parts[1] + Mask(parts[2])
+	})
+}
+
+// 属性名为以下值时总是输出指纹
+var sensitiveKeys = map[string]bool{
+	"token":        true,
+	"ticket":       true,
+	"secret":       true,
+	"app_secret":   true,
+	"access_token": true,
+	"password":     true,
+}
+
+func maskAttr(a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+
+	switch a.Value.Kind() {
+	case slog.KindGroup:
+		attrs := a.Value.Group()
+		masked := make([]any, 0, len(attrs))
+		for _, attr := range attrs {
+			masked = append(masked, maskAttr(attr))
+		}
+		return slog.Group(a.Key, masked...)
+	case slog.KindString:
+		if sensitiveKeys[strings.ToLower(a.Key)] && !strings.HasPrefix(a.Value.String(), "fp:") {
+			return slog.String(a.Key, Mask(a.Value.String()))
+		}
+		return slog.String(a.Key, Scrub(a.Value.String()))
+	case slog.KindAny:
+		//结构体,Stringer等按输出内容脱敏 不含敏感值时保持原值
+		rendered := renderAny(a.Value.Any())
+		if sensitiveKeys[strings.ToLower(a.Key)] && !strings.HasPrefix(rendered, "fp:") {
+			return slog.String(a.Key, Mask(rendered))
+		}
+		if _, ok := a.Value.Any().(error); ok {
+			return slog.String(a.Key, Scrub(rendered))
+		}
+		if masked := Scrub(rendered); masked != rendered {
+			return slog.String(a.Key, masked)
+		}
+	}
+
+	return a
+}
+
+// renderAny 返回日志中输出的文本 url.Values按查询串输出以便匹配凭证参数
+func renderAny(v any) string {
+	switch v := v.(type) {
+	case error:
+		return v.Error()
+	case url.Values:
+		return v.Encode()
+	case fmt.Stringer:
+		return v.String()
+	}
+
+	return fmt.Sprintf("%+v", v)
+}
+
+// maskHandler 输出前对消息及属性脱敏
+type maskHandler struct {
+	slog.Handler
+}
+
+func (h *maskHandler) Handle(ctx context.Context, r slog.Record) error {
+	masked := slog.NewRecord(r.Time, r.Level, Scrub(r.Message), r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		masked.AddAttrs(maskAttr(a))
+		return true
+	})
+
+	return h.Handler.Handle(ctx, masked)
+}
+
+func (h *maskHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	masked := make([]slog.Attr, 0, len(attrs))
+	for _, a := range attrs {
+		masked = append(masked, maskAttr(a))
+	}
+
+	return &maskHandler{h.Handler.WithAttrs(masked)}
+}
+
+func (h *maskHandler) WithGroup(name string) slog.Handler {
+	return &maskHandler{h.Handler.WithGroup(name)}
+}
+
+// LogWriter 将其他组件(如gin)的输出按行写入Logger
 type LogWriter struct {
-	name string
-	l    *log.Logger
-	w    io.Writer
+	l *slog.Logger
 }
 
 func NewLogWriter(name string) *LogWriter {
 	return &LogWriter{
-		name: name,
-		l:    log.New(os.Stdout, "", log.Ldate|log.Ltime),
+		l: Logger.With("component", name),
 	}
 }
 
 func (w *LogWriter) Write(d []byte) (int, error) {
-	w.l.Printf("%s|%s", w.name, string(d))
-	return 0, nil
+	w.l.Info(strings.TrimRight(string(d), "\n"))
+	return len(d), nil
 }
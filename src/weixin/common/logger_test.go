@@ -0,0 +1,65 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+type testStringer struct {
+	v string
+}
+
+func (s testStringer) String() string {
+	return "stringer " + s.v
+}
+
+func TestLoggerMask(t *testing.T) {
+	RegisterSecret("REGISTERED_SECRET")
+
+	tests := []struct {
+		name   string
+		attr   any
+		secret string
+	}{
+		{"Secret", Secret("SECRET_VALUE"), "SECRET_VALUE"},
+		{"token", "RAW_TOKEN", "RAW_TOKEN"},
+		{"app_secret", "RAW_APP_SECRET", "RAW_APP_SECRET"},
+		{"Token", struct{ V string }{"RAW_STRUCT_TOKEN"}, "RAW_STRUCT_TOKEN"},
+		{"api", "https://api.weixin.qq.com/cgi-bin/token?access_token=URL_TOKEN&secret=URL_SECRET", "URL_"},
+		{"error", errors.New("get https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpsecret=ERR_SECRET"), "ERR_SECRET"},
+		{"query", url.Values{"access_token": {"QUERY_TOKEN"}}, "QUERY_TOKEN"},
+		{"registered", "value REGISTERED_SECRET", "REGISTERED_SECRET"},
+		{"struct", struct{ Value string }{"REGISTERED_SECRET"}, "REGISTERED_SECRET"},
+		{"stringer", testStringer{"REGISTERED_SECRET"}, "REGISTERED_SECRET"},
+		{"group", slog.GroupValue(slog.String("ticket", "GROUP_TICKET")), "GROUP_TICKET"},
+	}
+
+	for _, format := range []string{"text", "json"} {
+		for _, tt := range tests {
+			t.Run(format+"/"+tt.name, func(t *testing.T) {
+				buf := new(bytes.Buffer)
+				logger := slog.New(newLogHandler(buf, format, false))
+
+				logger.Info("message", tt.name, tt.attr)
+				logger.With(tt.name, tt.attr).Info("with")
+				if strings.Contains(buf.String(), tt.secret) {
+					t.Fatalf("secret in log: %s", buf.String())
+				}
+				if !strings.Contains(buf.String(), "fp:") {
+					t.Fatalf("fingerprint not in log: %s", buf.String())
+				}
+			})
+		}
+	}
+
+	//消息中已登记的值同样替换
+	buf := new(bytes.Buffer)
+	slog.New(newLogHandler(buf, "text", false)).Info("refresh REGISTERED_SECRET", "count", 1, "stringer", testStringer{"plain"})
+	if strings.Contains(buf.String(), "REGISTERED_SECRET") || !strings.Contains(buf.String(), "stringer plain") {
+		t.Fatalf("log = %s", buf.String())
+	}
+}
@@ -0,0 +1,57 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+	"strings"
+	"time"
+)
+
+const secretExecTimeout = 10 * time.Second
+
+// ResolveSecret 解析密钥配置
+// env:NAME 读取环境变量
+// file:/path 读取文件内容
+// exec:/path/to/cmd args 执行命令取标准输出
+// 其他按明文处理
+func ResolveSecret(raw string) (string, error) {
+	provider, ref, found := strings.Cut(raw, ":")
+	if !found {
+		return raw, nil
+	}
+
+	switch provider {
+	case "env":
+		value, ok := os.LookupEnv(ref)
+		if !ok {
+			return "", fmt.Errorf("secret env %s not set", ref)
+		}
+		return strings.TrimSpace(value), nil
+	case "file":
+		content, err := os.ReadFile(ref)
+		if err != nil {
+			return "", fmt.Errorf("secret file %s read fail %v", ref, err)
+		}
+		return strings.TrimSpace(string(content)), nil
+	case "exec":
+		args := strings.Fields(ref)
+		if len(args) == 0 {
+			return "", errors.New("secret exec command empty")
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), secretExecTimeout)
+		defer cancel()
+
+		cmd := exec.CommandContext(ctx, args[0], args[1:]...)
+		output, err := cmd.Output()
+		if err != nil {
+			return "", fmt.Errorf("secret exec %s fail %v", args[0], err)
+		}
+		return strings.TrimSpace(string(output)), nil
+	}
+
+	return raw, nil
+}
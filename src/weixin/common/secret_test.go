@@ -0,0 +1,50 @@
+package common
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestResolveSecret(t *testing.T) {
+	dir := t.TempDir()
+	file := filepath.Join(dir, "secret")
+	if err := os.WriteFile(file, []byte("  from_file\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("WEIXIN_TEST_SECRET", " from_env\n")
+
+	tests := []struct {
+		raw  string
+		want string
+		err  string
+	}{
+		{raw: "plain", want: "plain"},
+		{raw: "", want: ""},
+		{raw: "other:value", want: "other:value"},
+		{raw: "env:WEIXIN_TEST_SECRET", want: "from_env"},
+		{raw: "env:WEIXIN_TEST_SECRET_MISSING", err: "secret env WEIXIN_TEST_SECRET_MISSING not set"},
+		{raw: "file:" + file, want: "from_file"},
+		{raw: "file:" + filepath.Join(dir, "missing"), err: "secret file"},
+		{raw: "exec:echo  from_exec ", want: "from_exec"},
+		{raw: "exec:false", err: "secret exec false fail"},
+		{raw: "exec:/nonexistent/command", err: "secret exec /nonexistent/command fail"},
+		{raw: "exec: ", err: "secret exec command empty"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			got, err := ResolveSecret(tt.raw)
+			if len(tt.err) > 0 {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("ResolveSecret(%q) err = %v, want %q", tt.raw, err, tt.err)
+				}
+				return
+			}
+			if err != nil || got != tt.want {
+				t.Fatalf("ResolveSecret(%q) = %q %v, want %q", tt.raw, got, err, tt.want)
+			}
+		})
+	}
+}
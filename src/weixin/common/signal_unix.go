@@ -0,0 +1,15 @@
+//go:build !windows
+
+package common
+
+import (
+	"os"
+	"os/signal"
+	"syscall"
+)
+
+// notifyReopen 收到SIGUSR1时重新打开日志文件
+func notifyReopen(ch chan os.Signal) bool {
+	signal.Notify(ch, syscall.SIGUSR1)
+	return true
+}
@@ -0,0 +1,12 @@
+//go:build windows
+
+package common
+
+import (
+	"os"
+)
+
+// notifyReopen windows不支持SIGUSR1
+func notifyReopen(ch chan os.Signal) bool {
+	return false
+}
@@ -0,0 +1,136 @@
+package core
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/redcon"
+	"strings"
+	"time"
+	"weixin/common"
+)
+
+const accessRecordKey = "access"
+
+// accessRecord 单次请求的访问日志 由处理函数填充缓存及结果
+type accessRecord struct {
+	section string
+	cache   []string
+	result  string
+	status  int
+}
+
+// track 记录一次token或ticket获取结果
+func (r *accessRecord) track(kind string, wxValue *WValues, cacheFirst bool, err error) {
+	cache := "miss"
+	if !cacheFirst {
+		cache = "forced"
+	} else if wxValue != nil && wxValue.source == sourceCache {
+		cache = "hit"
+	}
+	r.cache = append(r.cache, kind+":"+cache)
+
+	if err != nil {
+		r.fail(err.Error())
+	}
+}
+
+func (r *accessRecord) fail(result string) {
+	if len(r.result) == 0 || r.result == "ok" {
+		r.result = result
+	}
+}
+
+func respRecord(conn redcon.Conn) *accessRecord {
+	if client, ok := conn.Context().(*respClient); ok && client.access != nil {
+		return client.access
+	}
+	//未经handleCommand包装的命令 记录后丢弃
+	return &accessRecord{}
+}
+
+func httpRecord(c *gin.Context) *accessRecord {
+	if v, ok := c.Get(accessRecordKey); ok {
+		return v.(*accessRecord)
+	}
+	return &accessRecord{}
+}
+
+func writeAccess(protocol, client, command string, record *accessRecord, startAt time.Time) {
+	attrs := []any{
+		"protocol", protocol,
+		"client", client,
+		"command", command,
+		"section", record.section,
+		"cache", strings.Join(record.cache, ","),
+		"result", record.result,
+		"latency", time.Since(startAt).String(),
+	}
+	if record.status > 0 {
+		attrs = append(attrs, "status", record.status)
+	}
+
+	common.AccessLogger.Info("access", attrs...)
+}
+
+// handleCommand 包装RESP命令 统计耗时并记录访问日志 section由处理函数按需填充
+func handleCommand(command string, handler func(conn redcon.Conn, cmd redcon.Command)) func(conn redcon.Conn, cmd redcon.Command) {
+	if !isRespCommand(command) {
+		respCommands = append(respCommands, command)
+	}
+
+	return func(conn redcon.Conn, cmd redcon.Command) {
+		startAt := time.Now()
+
+		record := &accessRecord{result: "ok"}
+
+		client := clientOf(conn)
+		client.access = record
+		client.lastCommand.Store(command)
+		client.lastAt.Store(startAt.Unix())
+		totalCommands.Add(1)
+
+		client.beginCommand()
+		handler(conn, cmd)
+		client.endCommand()
+
+		client.access = nil
+
+		observeCommand("resp", command, record.section, startAt)
+		writeAccess("resp", conn.RemoteAddr(), command, record, startAt)
+	}
+}
+
+// handleSectionCommand 第一个参数为section的命令 如TOKEN section
+func handleSectionCommand(command string, handler func(conn redcon.Conn, cmd redcon.Command)) func(conn redcon.Conn, cmd redcon.Command) {
+	return handleCommand(command, func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) >= 2 {
+			respRecord(conn).section = string(cmd.Args[1])
+		}
+		handler(conn, cmd)
+	})
+}
+
+// handleRoute 统计HTTP路由耗时并记录访问日志
+func handleRoute() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		startAt := time.Now()
+
+		record := &accessRecord{section: c.Param("name")}
+		c.Set(accessRecordKey, record)
+
+		c.Next()
+
+		route := c.FullPath()
+		if len(route) == 0 {
+			route = "unknown"
+		}
+		route = strings.TrimSuffix(route, "/*flag")
+
+		if len(record.result) == 0 {
+			record.result = "ok"
+		}
+		record.status = c.Writer.Status()
+
+		observeCommand("http", route, record.section, startAt)
+		writeAccess("http", c.ClientIP(), c.Request.Method+" "+route, record, startAt)
+	}
+}
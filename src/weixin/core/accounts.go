@@ -0,0 +1,111 @@
+package core
+
+import (
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/redcon"
+	"net/http"
+	"weixin/common"
+)
+
+const (
+	accountOfficial   = "official"
+	accountEnterprise = "enterprise"
+)
+
+// accountInfo 已配置section的概况 app_secret只输出指纹
+type accountInfo struct {
+	Section      string      `json:"section"`
+	Type         string      `json:"type"`
+	AppId        string      `json:"appId"`
+	Secret       string      `json:"secret"`
+	Mock         bool        `json:"mock,omitempty"`
+	Breaker      string      `json:"breaker"`
+	Token        *kindHealth `json:"token"`
+	Ticket       *kindHealth `json:"ticket"`
+	WxCardTicket *kindHealth `json:"wxCardTicket,omitempty"`
+}
+
+func accountInfos() []*accountInfo {
+	m := manager()
+	names := m.Accounts()
+	infos := make([]*accountInfo, 0, len(names))
+
+	for _, name := range names {
+		account, _ := m.Account(name)
+		appId := account.AppId
+
+		info := &accountInfo{
+			Section: name,
+			Type:    accountOfficial,
+			AppId:   appId,
+			Secret:  common.Mask(account.AppSecret),
+			Mock:    account.Mock != nil,
+			Breaker: m.BreakerState(name),
+			Token:   kindHealthOf(name, kindToken, m.lookup(kindToken, appId)),
+			Ticket:  kindHealthOf(name, kindTicket, m.lookup(kindTicket, appId)),
+		}
+
+		if account.IsEnterprise {
+			info.Type = accountEnterprise
+		} else {
+			cardKind := kindTicket + ":" + ticketWxCard
+			info.WxCardTicket = kindHealthOf(name, cardKind, m.lookup(kindTicket, ticketKey(appId, ticketWxCard)))
+		}
+
+		infos = append(infos, info)
+	}
+
+	return infos
+}
+
+func kindHealthPairs(prefix string, kh *kindHealth) []interface{} {
+	return []interface{}{
+		prefix + "_cached", redcon.SimpleInt(boolInt(kh.Cached)),
+		prefix + "_expire_at", redcon.SimpleInt(kh.ExpireAt),
+		prefix + "_refresh_at", redcon.SimpleInt(kh.RefreshAt),
+		prefix + "_refresh_count", redcon.SimpleInt(kh.RefreshCount),
+		prefix + "_last_error", kh.LastError,
+		prefix + "_last_error_at", redcon.SimpleInt(kh.LastErrorAt),
+	}
+}
+
+func boolInt(v bool) int {
+	if v {
+		return 1
+	}
+	return 0
+}
+
+// handleAccounts ACCOUNTS 每个section返回一个map RESP2下为key,value数组
+func handleAccounts(conn redcon.Conn, cmd redcon.Command) {
+	client := clientOf(conn)
+	client.Lock()
+	proto := client.proto
+	client.Unlock()
+
+	infos := accountInfos()
+
+	conn.WriteArray(len(infos))
+	for _, info := range infos {
+		pairs := []interface{}{
+			"section", info.Section,
+			"type", info.Type,
+			"app_id", info.AppId,
+			"secret", info.Secret,
+			"mock", redcon.SimpleInt(boolInt(info.Mock)),
+			"breaker", info.Breaker,
+		}
+		pairs = append(pairs, kindHealthPairs("token", info.Token)...)
+		pairs = append(pairs, kindHealthPairs("ticket", info.Ticket)...)
+		if info.WxCardTicket != nil {
+			pairs = append(pairs, kindHealthPairs("wx_card_ticket", info.WxCardTicket)...)
+		}
+
+		writeMap(conn, proto, pairs...)
+	}
+}
+
+// accounts GET /accounts
+func accounts(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{"accounts": accountInfos()})
+}
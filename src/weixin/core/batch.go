@@ -0,0 +1,159 @@
+package core
+
+import (
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/tidwall/redcon"
+	"net/http"
+	"sync"
+)
+
+// 批量获取时同时请求微信接口的最大数量
+const batchConcurrency = 16
+
+const maxBatchItems = 1000
+
+type batchItem struct {
+	Section string `json:"section"`
+	Kind    string `json:"kind"`
+}
+
+type batchResult struct {
+	Section  string `json:"section"`
+	Kind     string `json:"kind"`
+	Value    string `json:"value"`
+	ExpireAt int64  `json:"expireAt"`
+	Error    string `json:"error,omitempty"`
+
+	wxValue *WValues
+	err     error
+}
+
+// fetchBatch 并发获取多个section的token或ticket 结果顺序与items一致
+// 同一公众号的请求由刷新锁串行 不同公众号并发请求微信接口
+func fetchBatch(items []batchItem, cacheFirst bool) []*batchResult {
+	results := make([]*batchResult, len(items))
+
+	var wg sync.WaitGroup
+	sem := make(chan struct{}, batchConcurrency)
+
+	for i, item := range items {
+		wg.Add(1)
+		sem <- struct{}{}
+
+		go func(i int, item batchItem) {
+			defer func() {
+				<-sem
+				wg.Done()
+			}()
+
+			result := &batchResult{Section: item.Section, Kind: item.Kind}
+			switch item.Kind {
+			case kindToken:
+				result.wxValue, result.err = GetToken(item.Section, cacheFirst)
+			case kindTicket:
+				result.wxValue, result.err = GetTicket(item.Section, cacheFirst)
+			default:
+				result.err = newWError(errInvalidType, fmt.Sprintf("ERR unknown kind %v", item.Kind))
+			}
+
+			if result.err == nil {
+				result.Value = result.wxValue.value
+				result.ExpireAt = result.wxValue.expireAt.Unix()
+			} else {
+				result.Error = result.err.Error()
+			}
+
+			results[i] = result
+		}(i, item)
+	}
+
+	wg.Wait()
+
+	return results
+}
+
+func batchItems(kind string, sections []string) []batchItem {
+	items := make([]batchItem, 0, len(sections))
+	for _, section := range sections {
+		items = append(items, batchItem{Section: section, Kind: kind})
+	}
+	return items
+}
+
+// handleMulti MZTOKEN,MZTICKET 每个section返回value及expireAt 失败时为空串及0
+func handleMulti(kind string) func(conn redcon.Conn, cmd redcon.Command) {
+	return func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError(fmt.Sprintf("ERR command args with m%s", kind))
+			return
+		}
+		if len(cmd.Args)-1 > maxBatchItems {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError(fmt.Sprintf("ERR too many sections, max %d", maxBatchItems))
+			return
+		}
+
+		sections := make([]string, 0, len(cmd.Args)-1)
+		for _, arg := range cmd.Args[1:] {
+			sections = append(sections, string(arg))
+		}
+
+		record := respRecord(conn)
+
+		results := fetchBatch(batchItems(kind, sections), true)
+
+		conn.WriteArray(len(results))
+		for _, result := range results {
+			record.track(kind, result.wxValue, true, result.err)
+
+			conn.WriteArray(2)
+			conn.WriteBulkString(result.Value)
+			conn.WriteBulkString(fmt.Sprintf("%d", result.ExpireAt))
+		}
+	}
+}
+
+type batchRequest struct {
+	Sections []string    `json:"sections"`
+	Kinds    []string    `json:"kinds"`
+	Items    []batchItem `json:"items"`
+	Force    bool        `json:"force"`
+}
+
+// batch POST /batch sections与kinds组合 或直接指定items
+func batch(c *gin.Context) {
+	var req batchRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		httpRecord(c).fail("invalid args")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request body"})
+		return
+	}
+
+	items := req.Items
+	kinds := req.Kinds
+	if len(kinds) == 0 {
+		kinds = []string{kindToken}
+	}
+	for _, section := range req.Sections {
+		for _, kind := range kinds {
+			items = append(items, batchItem{Section: section, Kind: kind})
+		}
+	}
+
+	if len(items) == 0 || len(items) > maxBatchItems {
+		httpRecord(c).fail("invalid args")
+		c.JSON(http.StatusBadRequest, gin.H{"error": fmt.Sprintf("items count must between 1 and %d", maxBatchItems)})
+		return
+	}
+
+	results := fetchBatch(items, !req.Force)
+
+	record := httpRecord(c)
+	for _, result := range results {
+		record.track(result.Kind, result.wxValue, !req.Force, result.err)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"items": results})
+}
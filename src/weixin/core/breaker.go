@@ -0,0 +1,149 @@
+package core
+
+import (
+	"fmt"
+	"sync"
+	"time"
+	"weixin/common"
+)
+
+const (
+	breakerClosed   = "closed"
+	breakerOpen     = "open"
+	breakerHalfOpen = "half_open"
+)
+
+// BreakerPolicy 连续Threshold次请求微信接口失败(包括返回错误码)后熔断 Cooldown后放行一次探测 Threshold为0时不熔断
+type BreakerPolicy struct {
+	Threshold int
+	Cooldown  time.Duration
+}
+
+// breaker 每个section一个 探测成功后恢复 失败后重新计时
+type breaker struct {
+	state    string
+	failures int
+	openedAt time.Time
+}
+
+type breakers struct {
+	sync.Mutex
+	policy BreakerPolicy
+	m      map[string]*breaker
+}
+
+func newBreakers(policy BreakerPolicy) *breakers {
+	return &breakers{policy: policy, m: make(map[string]*breaker)}
+}
+
+func (bs *breakers) get(name string) *breaker {
+	b, ok := bs.m[name]
+	if !ok {
+		b = &breaker{state: breakerClosed}
+		bs.m[name] = b
+	}
+	return b
+}
+
+// allow 熔断期间返回false及剩余时间 冷却结束后只放行一次探测
+func (bs *breakers) allow(name string, now time.Time) (bool, time.Duration) {
+	if bs.policy.Threshold <= 0 {
+		return true, 0
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	b := bs.get(name)
+	switch b.state {
+	case breakerOpen:
+		if wait := b.openedAt.Add(bs.policy.Cooldown).Sub(now); wait > 0 {
+			return false, wait
+		}
+		b.state = breakerHalfOpen
+		common.Logger.Info("weixin api circuit half open, probing", "section", name)
+		return true, 0
+	case breakerHalfOpen:
+		//探测进行中
+		return false, bs.policy.Cooldown
+	}
+
+	return true, 0
+}
+
+// done 记录一次请求结果 failed为请求失败,响应无法解析或返回非0错误码
+func (bs *breakers) done(name string, failed bool, now time.Time) {
+	if bs.policy.Threshold <= 0 {
+		return
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	b := bs.get(name)
+	if !failed {
+		if b.state != breakerClosed {
+			common.Logger.Info("weixin api circuit closed", "section", name)
+		}
+		b.state = breakerClosed
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.state == breakerHalfOpen || b.failures >= bs.policy.Threshold {
+		if b.state != breakerOpen {
+			common.Logger.Warn("weixin api circuit open", "section", name, "failures", b.failures, "cooldown", bs.policy.Cooldown)
+		}
+		b.state = breakerOpen
+		b.openedAt = now
+	}
+}
+
+func (bs *breakers) state(name string) string {
+	if bs.policy.Threshold <= 0 {
+		return breakerClosed
+	}
+
+	bs.Lock()
+	defer bs.Unlock()
+
+	if b, ok := bs.m[name]; ok {
+		return b.state
+	}
+	return breakerClosed
+}
+
+type breakerOpenError struct {
+	wait time.Duration
+}
+
+func (e *breakerOpenError) Error() string {
+	return "weixin api circuit open"
+}
+
+// BreakerState section的熔断状态 closed,open或half_open
+func (m *Manager) BreakerState(name string) string {
+	return m.breakers.state(name)
+}
+
+// openBreakers 处于open或half_open的section数量
+func (m *Manager) openBreakers() int {
+	n := 0
+	for _, name := range m.names {
+		if m.breakers.state(name) != breakerClosed {
+			n++
+		}
+	}
+	return n
+}
+
+// shortCircuit 熔断期间返回仍有效的缓存值 没有时返回upstream_circuit_open
+func (m *Manager) shortCircuit(wi *WItem, kind, key string, wait time.Duration) (*WValues, error) {
+	if v := m.lookup(kind, key); v != nil {
+		observeCache(wi, kind, "hit")
+		return v.cached(), nil
+	}
+
+	return nil, newWError(errCircuitOpen, fmt.Sprintf("weixin api circuit open for %s, retry after %ds", wi.Name, int(wait.Seconds())+1))
+}
@@ -0,0 +1,213 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+	"weixin/common"
+)
+
+const (
+	clusterWaitTimeout  = 5 * time.Second
+	clusterWaitInterval = 200 * time.Millisecond
+)
+
+// Cluster 集群模式下多个实例通过共享存储同步token&ticket
+// 需要刷新的实例获取appId的租约后请求微信接口 完成后释放 同一时间只有一个实例刷新 其他实例等待并使用共享值
+// 刷新期间定期续约 持有者宕机后租约过期 等待中的实例接管刷新
+type Cluster struct {
+	sync.Mutex
+	storage SharedStorage
+	owner   string
+	lease   time.Duration
+	wait    time.Duration
+	held    map[string]int
+}
+
+// NewCluster owner为实例标识 lease为刷新租约有效期
+func NewCluster(storage Storage, owner string, lease time.Duration) (*Cluster, error) {
+	shared, ok := storage.(SharedStorage)
+	if !ok {
+		return nil, errors.New("cluster mode need shared storage such as redis")
+	}
+
+	return &Cluster{
+		storage: shared,
+		owner:   owner,
+		lease:   lease,
+		wait:    clusterWaitTimeout,
+		held:    make(map[string]int),
+	}, nil
+}
+
+func (c *Cluster) Owner() string {
+	return c.owner
+}
+
+// lookup 返回共享存储中未过期的值 err不为nil时表示共享存储不可用
+func (c *Cluster) lookup(kind, appId string) (*WValues, error) {
+	v, err := c.storage.Get(kind, appId)
+	if err != nil {
+		return nil, err
+	}
+
+	if v == nil || v.expireAt.Before(time.Now()) {
+		return nil, nil
+	}
+
+	common.RegisterSecret(v.value)
+
+	return v, nil
+}
+
+// get 同lookup 共享存储不可用时记录日志并返回nil
+func (c *Cluster) get(kind, appId string) *WValues {
+	v, err := c.lookup(kind, appId)
+	if err != nil {
+		common.Logger.Warn("cluster get fail", "kind", kind, "appId", appId, "err", err)
+		return nil
+	}
+
+	return v
+}
+
+func (c *Cluster) publish(kind, appId string, v *WValues) {
+	if err := c.storage.Set(kind, appId, v); err != nil {
+		common.Logger.Warn("cluster publish fail", "kind", kind, "appId", appId, "err", err)
+	}
+}
+
+// acquire 获取appId的租约 本实例已持有时增加引用计数(ticket刷新时会先刷新token)
+func (c *Cluster) acquire(appId string) bool {
+	ok, err := c.storage.AcquireLease(appId, c.owner, c.lease)
+	if err != nil {
+		common.Logger.Warn("cluster acquire lease fail", "appId", appId, "err", err)
+		return false
+	}
+	if !ok {
+		return false
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if c.held[appId] == 0 {
+		common.Logger.Debug("cluster become refresher", "appId", appId, "owner", c.owner)
+	}
+	c.held[appId]++
+
+	return true
+}
+
+// release 刷新完成后释放租约 引用计数归零时删除共享存储中的租约
+func (c *Cluster) release(appId string) {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.held[appId] == 0 {
+		return
+	}
+
+	c.held[appId]--
+	if c.held[appId] > 0 {
+		return
+	}
+
+	delete(c.held, appId)
+	if err := c.storage.ReleaseLease(appId, c.owner); err != nil {
+		common.Logger.Warn("cluster release lease fail", "appId", appId, "err", err)
+	}
+}
+
+// resolve 决定本实例是否需要请求微信接口
+// 返回共享值时直接使用 返回nil,nil时表示本实例已获取租约需自行刷新 刷新后调用release
+func (c *Cluster) resolve(kind, appId string, stale *WValues, cacheFirst bool) (*WValues, error) {
+	shared := c.get(kind, appId)
+	if shared != nil {
+		if cacheFirst {
+			return shared, nil
+		}
+		//强制刷新时其他实例已更新过
+		if stale != nil && shared.value != stale.value {
+			return shared, nil
+		}
+	}
+
+	old := stale
+	if old == nil {
+		old = shared
+	}
+
+	//replaced 其他实例已发布新值
+	replaced := func() *WValues {
+		v := c.get(kind, appId)
+		if v != nil && (old == nil || v.value != old.value) {
+			return v
+		}
+		return nil
+	}
+
+	deadline := time.Now().Add(c.wait)
+	for {
+		if c.acquire(appId) {
+			//获取租约前其他实例可能刚完成刷新
+			if v := replaced(); v != nil {
+				c.release(appId)
+				return v, nil
+			}
+			return nil, nil
+		}
+
+		if !time.Now().Before(deadline) {
+			break
+		}
+		time.Sleep(clusterWaitInterval)
+
+		if v := replaced(); v != nil {
+			return v, nil
+		}
+	}
+
+	return nil, newWError(errClusterTimeout, fmt.Sprintf("wait cluster refresher %s timeout", kind))
+}
+
+// Run 定期续约刷新中的租约 退出时释放
+func (c *Cluster) Run(ctx *common.ServerContext) {
+	defer ctx.Done()
+	ctx.Add()
+
+	common.Logger.Info("run cluster mode", "owner", c.owner, "lease", c.lease)
+
+	ticker := time.NewTicker(c.lease / 3)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			c.Lock()
+			appIds := make([]string, 0, len(c.held))
+			for appId := range c.held {
+				appIds = append(appIds, appId)
+			}
+			c.Unlock()
+
+			for _, appId := range appIds {
+				if _, err := c.storage.AcquireLease(appId, c.owner, c.lease); err != nil {
+					common.Logger.Warn("cluster renew lease fail", "appId", appId, "err", err)
+				}
+			}
+		case <-ctx.Quit():
+			common.Logger.Info("cluster catch exit signal")
+			c.Lock()
+			for appId := range c.held {
+				if err := c.storage.ReleaseLease(appId, c.owner); err != nil {
+					common.Logger.Warn("cluster release lease fail", "appId", appId, "err", err)
+				}
+			}
+			c.held = make(map[string]int)
+			c.Unlock()
+			return
+		}
+	}
+}
@@ -0,0 +1,193 @@
+package core
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"sync"
+	"testing"
+	"time"
+	"weixin/wxtest"
+)
+
+const testLease = 30 * time.Second
+
+type clusterNode struct {
+	m       *Manager
+	cluster *Cluster
+}
+
+// setupCluster 两个实例共享同一个redis存储
+func setupCluster(t *testing.T) (*miniredis.Miniredis, *clusterNode, *clusterNode) {
+	t.Helper()
+
+	setup(t)
+	mr := miniredis.RunT(t)
+
+	node := func(owner string) *clusterNode {
+		storage, err := NewRedisStorage(mr.Addr(), "", 0, "weixin:", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { storage.Close() })
+
+		cluster, err := NewCluster(storage, owner, testLease)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cluster.wait = 300 * time.Millisecond
+
+		m, err := NewManager(ManagerConfig{
+			Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+			Storage:    storage,
+			Cluster:    cluster,
+			HTTPClient: fake.Client(),
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		return &clusterNode{m: m, cluster: cluster}
+	}
+
+	return mr, node("a"), node("b")
+}
+
+func TestClusterFollowerForcedRefresh(t *testing.T) {
+	_, a, b := setupCluster(t)
+
+	first, err := a.m.Token("gzh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if shared, err := b.m.Token("gzh", true); err != nil || shared.Value() != first.Value() || shared.Source() != sourceShared {
+		t.Fatalf("follower token = %v %v", shared, err)
+	}
+	expectRequests(t, wxtest.Token, 1)
+
+	//follower强制刷新时自行获取租约刷新
+	forced, err := b.m.Token("gzh", false)
+	if err != nil || forced.Value() == first.Value() || forced.Value() != fake.CurrentToken(testAppId) {
+		t.Fatalf("follower forced token = %v %v", forced, err)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	//另一实例以旧值强制刷新时直接使用新值
+	if v, err := a.m.Token("gzh", false); err != nil || v.Value() != forced.Value() {
+		t.Fatalf("forced token with stale value = %v %v", v, err)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	if len(a.cluster.held) != 0 || len(b.cluster.held) != 0 {
+		t.Fatalf("leases should be released: %v %v", a.cluster.held, b.cluster.held)
+	}
+}
+
+func TestClusterExpired(t *testing.T) {
+	_, a, b := setupCluster(t)
+
+	//有效期10秒的token刷新后立即过期
+	fake.Push(wxtest.Token, wxtest.Expires(10))
+	if _, err := a.m.Token("gzh", true); err != nil {
+		t.Fatal(err)
+	}
+
+	v, err := b.m.Token("gzh", true)
+	if err != nil || v.Value() != fake.CurrentToken(testAppId) || v.Source() != sourceUpstream {
+		t.Fatalf("follower token after expiry = %v %v", v, err)
+	}
+	expectRequests(t, wxtest.Token, 2)
+}
+
+func TestClusterSingleRefresher(t *testing.T) {
+	_, a, b := setupCluster(t)
+
+	fake.Push(wxtest.Token, wxtest.Timeout(100*time.Millisecond))
+
+	var wg sync.WaitGroup
+	values := make([]string, 2)
+	for i, node := range []*clusterNode{a, b} {
+		wg.Add(1)
+		go func(i int, m *Manager) {
+			defer wg.Done()
+			if v, err := m.Token("gzh", true); err == nil {
+				values[i] = v.Value()
+			}
+		}(i, node.m)
+		time.Sleep(20 * time.Millisecond)
+	}
+	wg.Wait()
+
+	if values[0] == "" || values[0] != values[1] {
+		t.Fatalf("tokens = %v", values)
+	}
+	expectRequests(t, wxtest.Token, 1)
+}
+
+func TestClusterLeaderLoss(t *testing.T) {
+	mr, a, b := setupCluster(t)
+
+	//a获取租约后宕机 未发布新值也未释放租约
+	if !a.cluster.acquire(testAppId) {
+		t.Fatal("acquire lease fail")
+	}
+
+	if _, err := b.m.Token("gzh", true); err == nil || err.(*WError).Code != errClusterTimeout {
+		t.Fatalf("token while lease held = %v", err)
+	}
+	expectRequests(t, wxtest.Token, 0)
+
+	mr.FastForward(testLease)
+
+	v, err := b.m.Token("gzh", true)
+	if err != nil || v.Value() != fake.CurrentToken(testAppId) {
+		t.Fatalf("token after lease expired = %v %v", v, err)
+	}
+	expectRequests(t, wxtest.Token, 1)
+}
+
+// 持有者刷新失败释放租约后 等待中的实例接管
+func TestClusterTakeoverAfterRelease(t *testing.T) {
+	_, a, b := setupCluster(t)
+
+	a.cluster.acquire(testAppId)
+	time.AfterFunc(100*time.Millisecond, func() { a.cluster.release(testAppId) })
+
+	v, err := b.m.Token("gzh", false)
+	if err != nil || v.Value() != fake.CurrentToken(testAppId) {
+		t.Fatalf("token after takeover = %v %v", v, err)
+	}
+	expectRequests(t, wxtest.Token, 1)
+}
+
+// 其他实例强制刷新后 本地缓存的旧值不再使用 也不会被Save写回或删除
+func TestClusterStaleLocalCache(t *testing.T) {
+	_, a, b := setupCluster(t)
+
+	first, err := a.m.Token("gzh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	forced, err := b.m.Token("gzh", false)
+	if err != nil || forced.Value() == first.Value() {
+		t.Fatalf("forced token = %v %v", forced, err)
+	}
+
+	a.m.Save()
+	if shared := a.cluster.get(kindToken, testAppId); shared == nil || shared.value != forced.Value() {
+		t.Fatalf("shared token after follower save = %v", shared)
+	}
+
+	v, err := a.m.Token("gzh", true)
+	if err != nil || v.Value() != forced.Value() || v.Source() != sourceShared {
+		t.Fatalf("cached token after other instance refreshed = %v %v", v, err)
+	}
+	if v, err := a.m.Token("gzh", true); err != nil || v.Value() != forced.Value() || v.Source() != sourceCache {
+		t.Fatalf("cached token = %v %v", v, err)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	a.m.remove(kindToken, testAppId)
+	a.m.Save()
+	if shared := a.cluster.get(kindToken, testAppId); shared == nil {
+		t.Fatal("follower save should not delete shared token")
+	}
+}
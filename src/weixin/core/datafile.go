@@ -0,0 +1,159 @@
+package core
+
+import (
+	"errors"
+	"fmt"
+	"github.com/tidwall/gjson"
+	"os"
+	"path/filepath"
+	"weixin/common"
+)
+
+// backupDataFile 返回第n个备份文件路径
+func backupDataFile(path string, n int) string {
+	return fmt.Sprintf("%s.%d", path, n)
+}
+
+// writeDataFile 先写临时文件并fsync 再rename覆盖 保证数据文件始终完整
+// backups>0时保留最近backups份旧数据文件 path.1为最新
+func writeDataFile(path string, content []byte, backups int) error {
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+
+	tmpName := tmp.Name()
+	defer os.Remove(tmpName)
+
+	if _, err = tmp.Write(content); err == nil {
+		err = tmp.Sync()
+	}
+	if closeErr := tmp.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Chmod(tmpName, 0600)
+	}
+	if err != nil {
+		return err
+	}
+
+	if backups > 0 {
+		rotateDataFile(path, backups)
+	}
+
+	if err = os.Rename(tmpName, path); err != nil {
+		return err
+	}
+
+	syncDir(filepath.Dir(path))
+
+	return nil
+}
+
+// rotateDataFile 依次后移备份 当前数据文件以硬链接(不支持时复制)保存为path.1
+// 数据文件本身保持不动 由随后的rename原子替换 期间任意时刻崩溃都有完整的数据文件
+func rotateDataFile(path string, backups int) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+
+	for i := backups - 1; i >= 1; i-- {
+		if _, err := os.Stat(backupDataFile(path, i)); err == nil {
+			os.Rename(backupDataFile(path, i), backupDataFile(path, i+1))
+		}
+	}
+
+	backup := backupDataFile(path, 1)
+	os.Remove(backup)
+	if err := os.Link(path, backup); err == nil {
+		return
+	}
+
+	if err := copyDataFile(path, backup); err != nil {
+		common.Logger.Warn("rotate data file fail", "err", err)
+	}
+}
+
+func copyDataFile(src, dst string) error {
+	content, err := os.ReadFile(src)
+	if err != nil {
+		return err
+	}
+
+	return os.WriteFile(dst, content, 0600)
+}
+
+// syncDir 确保rename写入磁盘 部分平台不支持对目录fsync 忽略错误
+func syncDir(dir string) {
+	d, err := os.Open(dir)
+	if err != nil {
+		return
+	}
+	d.Sync()
+	d.Close()
+}
+
+// readDataFile 读取并校验数据文件 失败时依次尝试备份文件
+func readDataFile(path string, backups int, dataKey string) (gjson.Result, error) {
+	result, err := parseDataFile(path, dataKey)
+	if err == nil {
+		return result, nil
+	}
+
+	common.Logger.Warn("read data file fail", "path", path, "err", err)
+
+	for i := 1; i <= backups; i++ {
+		backup := backupDataFile(path, i)
+		result, backupErr := parseDataFile(backup, dataKey)
+		if backupErr == nil {
+			common.Logger.Info("fallback to backup data file", "path", backup)
+			return result, nil
+		}
+		if !os.IsNotExist(backupErr) {
+			common.Logger.Warn("read data file fail", "path", backup, "err", backupErr)
+		}
+	}
+
+	return gjson.Result{}, err
+}
+
+func parseDataFile(path, dataKey string) (gjson.Result, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		return gjson.Result{}, err
+	}
+
+	if common.IsEncrypted(content) {
+		if len(dataKey) == 0 {
+			return gjson.Result{}, errors.New("data file is encrypted but data_key not configured")
+		}
+
+		content, err = common.DecryptData(dataKey, content)
+		if err != nil {
+			return gjson.Result{}, fmt.Errorf("decrypt data file fail %v", err)
+		}
+	}
+
+	if !gjson.ValidBytes(content) {
+		return gjson.Result{}, errors.New("read error json format data")
+	}
+
+	return gjson.ParseBytes(content), nil
+}
+
+// lockDataFile 对path.lock加排他锁 防止多个实例写同一数据文件
+// 锁在进程退出时由系统释放
+func lockDataFile(path string) (*os.File, error) {
+	f, err := os.OpenFile(path+".lock", os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, err
+	}
+
+	if err = lockFile(f); err != nil {
+		f.Close()
+		return nil, fmt.Errorf("data file %s is locked by another instance %v", path, err)
+	}
+
+	return f, nil
+}
@@ -0,0 +1,120 @@
+package core
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+)
+
+func readFile(t *testing.T, path string) string {
+	t.Helper()
+
+	content, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(content)
+}
+
+func TestWriteDataFileRotate(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.dat")
+
+	for i := 1; i <= 4; i++ {
+		if err := writeDataFile(path, []byte(`{"v":`+strconv.Itoa(i)+`}`), 2); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for file, want := range map[string]string{
+		path:                    `{"v":4}`,
+		backupDataFile(path, 1): `{"v":3}`,
+		backupDataFile(path, 2): `{"v":2}`,
+	} {
+		if got := readFile(t, file); got != want {
+			t.Fatalf("%s = %s, want %s", file, got, want)
+		}
+	}
+	if _, err := os.Stat(backupDataFile(path, 3)); !os.IsNotExist(err) {
+		t.Fatalf("only 2 backups should be kept: %v", err)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil || info.Mode().Perm() != 0600 {
+		t.Fatalf("data file mode = %v %v", info.Mode(), err)
+	}
+
+	//临时文件均已清除
+	entries, _ := os.ReadDir(filepath.Dir(path))
+	if len(entries) != 3 {
+		t.Fatalf("files = %v", entries)
+	}
+}
+
+// 轮转后rename前崩溃 数据文件仍完整存在
+func TestRotateKeepsDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.dat")
+	if err := writeDataFile(path, []byte(`{"v":1}`), 0); err != nil {
+		t.Fatal(err)
+	}
+
+	rotateDataFile(path, 3)
+
+	if got := readFile(t, path); got != `{"v":1}` {
+		t.Fatalf("data file after rotate = %s", got)
+	}
+	if got := readFile(t, backupDataFile(path, 1)); got != `{"v":1}` {
+		t.Fatalf("backup after rotate = %s", got)
+	}
+
+	//硬链接的备份不随数据文件替换而改变
+	if err := writeDataFile(path, []byte(`{"v":2}`), 0); err != nil {
+		t.Fatal(err)
+	}
+	if got := readFile(t, backupDataFile(path, 1)); got != `{"v":1}` {
+		t.Fatalf("backup after replace = %s", got)
+	}
+}
+
+func TestReadDataFileFallback(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.dat")
+
+	writeDataFile(path, []byte(`{"v":1}`), 2)
+	writeDataFile(path, []byte(`{"v":2}`), 2)
+	os.WriteFile(path, []byte(`{"v":`), 0600)
+
+	result, err := readDataFile(path, 2, "")
+	if err != nil || result.Get("v").Int() != 1 {
+		t.Fatalf("fallback = %v %v", result, err)
+	}
+
+	//备份同样损坏时返回数据文件的错误
+	os.WriteFile(backupDataFile(path, 1), []byte("corrupt"), 0600)
+	if _, err := readDataFile(path, 2, ""); err == nil {
+		t.Fatal("all data files corrupt should fail")
+	}
+
+	if _, err := readDataFile(filepath.Join(t.TempDir(), "missing.dat"), 2, ""); !os.IsNotExist(err) {
+		t.Fatalf("missing data file err = %v", err)
+	}
+}
+
+func TestLockDataFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "data.dat")
+
+	lock, err := lockDataFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := lockDataFile(path); err == nil {
+		t.Fatal("second lock should fail")
+	}
+
+	lock.Close()
+
+	again, err := lockDataFile(path)
+	if err != nil {
+		t.Fatalf("lock after release = %v", err)
+	}
+	again.Close()
+}
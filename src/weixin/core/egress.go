@@ -0,0 +1,115 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// Egress 请求微信接口的出口 微信按出口IP校验白名单 HttpProxy与Socks5Proxy只能配置一个
+type Egress struct {
+	// HttpProxy http://[user:pass@]host:port
+	HttpProxy string
+	// Socks5Proxy [user:pass@]host:port 或socks5://开头
+	Socks5Proxy string
+	// BindAddress 发起连接的本机IP 使用代理时为连接代理的地址
+	BindAddress string
+}
+
+func (e Egress) isZero() bool {
+	return e == Egress{}
+}
+
+// proxyURL 未配置代理时返回nil
+func (e Egress) proxyURL() (*url.URL, error) {
+	raw := e.HttpProxy
+	if len(e.Socks5Proxy) > 0 {
+		raw = e.Socks5Proxy
+		if !strings.Contains(raw, "://") {
+			raw = "socks5://" + raw
+		}
+	}
+	if len(raw) == 0 {
+		return nil, nil
+	}
+
+	u, err := url.Parse(raw)
+	if err != nil {
+		return nil, err
+	}
+	if len(u.Host) == 0 {
+		return nil, fmt.Errorf("proxy %s without host", u.Redacted())
+	}
+
+	return u, nil
+}
+
+// Validate 检查代理地址及bind_address
+func (e Egress) Validate() error {
+	if len(e.HttpProxy) > 0 && len(e.Socks5Proxy) > 0 {
+		return fmt.Errorf("http_proxy and socks5_proxy are exclusive")
+	}
+
+	u, err := e.proxyURL()
+	if err != nil {
+		return err
+	}
+	if u != nil && len(e.HttpProxy) > 0 && u.Scheme != "http" && u.Scheme != "https" {
+		return fmt.Errorf("invalid http_proxy scheme %s", u.Scheme)
+	}
+	if u != nil && len(e.Socks5Proxy) > 0 && u.Scheme != "socks5" && u.Scheme != "socks5h" {
+		return fmt.Errorf("invalid socks5_proxy scheme %s", u.Scheme)
+	}
+
+	if len(e.BindAddress) > 0 && net.ParseIP(e.BindAddress) == nil {
+		return fmt.Errorf("invalid bind_address %s", e.BindAddress)
+	}
+
+	return nil
+}
+
+// String 日志中使用 代理密码不输出
+func (e Egress) String() string {
+	parts := make([]string, 0, 2)
+	if u, err := e.proxyURL(); err == nil && u != nil {
+		parts = append(parts, u.Redacted())
+	}
+	if len(e.BindAddress) > 0 {
+		parts = append(parts, "bind "+e.BindAddress)
+	}
+	if len(parts) == 0 {
+		return "direct"
+	}
+
+	return strings.Join(parts, " ")
+}
+
+// transport 返回egress对应的Transport 相同出口的section共用连接池
+func (m *Manager) transport(egress Egress) (*http.Transport, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if t, ok := m.transports[egress]; ok {
+		return t, nil
+	}
+
+	setting := DefaultSetting()
+
+	u, err := egress.proxyURL()
+	if err != nil {
+		return nil, err
+	}
+	if u != nil {
+		setting.Proxy = http.ProxyURL(u)
+	}
+	if len(egress.BindAddress) > 0 {
+		setting.LocalAddr = &net.TCPAddr{IP: net.ParseIP(egress.BindAddress)}
+	}
+
+	t := NewTransport(setting)
+	m.transports[egress] = t
+
+	return t, nil
+}
@@ -0,0 +1,298 @@
+package core
+
+import (
+	"context"
+	"errors"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/peer"
+	"google.golang.org/grpc/status"
+	"net"
+	"path"
+	"strconv"
+	"sync"
+	"time"
+	"weixin/common"
+	"weixin/pb"
+)
+
+const grpcErrorDomain = "weixin"
+
+var grpcErrorCodes = map[string]codes.Code{
+	errNotFound:        codes.NotFound,
+	errInvalidType:     codes.InvalidArgument,
+	errInvalidArgument: codes.InvalidArgument,
+	errInvalidConfig:   codes.FailedPrecondition,
+	errUpstreamFail:    codes.Unavailable,
+	errUpstreamReject:  codes.Unavailable,
+	errClusterTimeout:  codes.DeadlineExceeded,
+	errCircuitOpen:     codes.Unavailable,
+}
+
+type grpcRecordKey struct{}
+
+func grpcRecord(ctx context.Context) *accessRecord {
+	if record, ok := ctx.Value(grpcRecordKey{}).(*accessRecord); ok {
+		return record
+	}
+	return &accessRecord{}
+}
+
+// grpcError WError转换为grpc status 微信接口返回的errcode及errmsg放入ErrorInfo
+func grpcError(err error) error {
+	var we *WError
+	if !errors.As(err, &we) {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	code, ok := grpcErrorCodes[we.Code]
+	if !ok {
+		code = codes.Internal
+	}
+
+	info := &errdetails.ErrorInfo{Reason: we.Code, Domain: grpcErrorDomain}
+	if we.ErrCode != 0 {
+		info.Metadata = map[string]string{
+			"errcode": strconv.Itoa(we.ErrCode),
+			"errmsg":  we.ErrMsg,
+		}
+	}
+
+	st, detailErr := status.New(code, we.Error()).WithDetails(info)
+	if detailErr != nil {
+		return status.Error(code, we.Error())
+	}
+
+	return st.Err()
+}
+
+func grpcValue(section, kind, ticketType string, wxValue *WValues) *pb.Value {
+	return &pb.Value{
+		Section:     section,
+		Kind:        kind,
+		Type:        ticketType,
+		Value:       wxValue.value,
+		ExpireAt:    wxValue.expireAt.Unix(),
+		ExpiresIn:   int64(time.Until(wxValue.expireAt).Seconds()),
+		RefreshedAt: unixOrZero(wxValue.refreshAt),
+		Source:      wxValue.source,
+	}
+}
+
+func grpcKindStatus(kh *kindHealth) *pb.KindStatus {
+	if kh == nil {
+		return nil
+	}
+
+	return &pb.KindStatus{
+		Cached:       kh.Cached,
+		ExpireAt:     kh.ExpireAt,
+		ExpiresIn:    kh.ExpiresIn,
+		RefreshAt:    kh.RefreshAt,
+		RefreshCount: int32(kh.RefreshCount),
+		LastError:    kh.LastError,
+		LastErrorAt:  kh.LastErrorAt,
+	}
+}
+
+type grpcServer struct {
+	pb.UnimplementedWeixinServer
+	quit <-chan struct{}
+}
+
+func (s *grpcServer) GetToken(ctx context.Context, req *pb.GetTokenRequest) (*pb.Value, error) {
+	cacheFirst := !req.GetForce()
+
+	wxValue, err := GetToken(req.GetSection(), cacheFirst)
+	grpcRecord(ctx).track(kindToken, wxValue, cacheFirst, err)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcValue(req.GetSection(), kindToken, "", wxValue), nil
+}
+
+func (s *grpcServer) GetTicket(ctx context.Context, req *pb.GetTicketRequest) (*pb.Value, error) {
+	cacheFirst := !req.GetForce()
+	ticketType := req.GetType()
+	if len(ticketType) == 0 {
+		ticketType = ticketJsapi
+	}
+
+	wxValue, err := GetTypedTicket(req.GetSection(), ticketType, cacheFirst)
+	grpcRecord(ctx).track(kindTicket, wxValue, cacheFirst, err)
+	if err != nil {
+		return nil, grpcError(err)
+	}
+
+	return grpcValue(req.GetSection(), kindTicket, ticketType, wxValue), nil
+}
+
+func (s *grpcServer) Sign(ctx context.Context, req *pb.SignRequest) (*pb.SignResponse, error) {
+	sign, err := Sign(req.GetSection(), req.GetUrl(), req.GetNonceStr(), req.GetTimestamp())
+	if err != nil {
+		grpcRecord(ctx).fail(err.Error())
+		return nil, grpcError(err)
+	}
+
+	return &pb.SignResponse{
+		AppId:     sign.AppId,
+		NonceStr:  sign.NonceStr,
+		Timestamp: sign.Timestamp,
+		Url:       sign.Url,
+		Signature: sign.Signature,
+	}, nil
+}
+
+func (s *grpcServer) ListAccounts(ctx context.Context, req *pb.ListAccountsRequest) (*pb.ListAccountsResponse, error) {
+	infos := accountInfos()
+
+	res := &pb.ListAccountsResponse{Accounts: make([]*pb.Account, 0, len(infos))}
+	for _, info := range infos {
+		res.Accounts = append(res.Accounts, &pb.Account{
+			Section:      info.Section,
+			Type:         info.Type,
+			AppId:        info.AppId,
+			Secret:       info.Secret,
+			Token:        grpcKindStatus(info.Token),
+			Ticket:       grpcKindStatus(info.Ticket),
+			WxCardTicket: grpcKindStatus(info.WxCardTicket),
+		})
+	}
+
+	return res, nil
+}
+
+// WatchRefresh 推送刷新后的新值 直到客户端断开或服务退出
+func (s *grpcServer) WatchRefresh(req *pb.WatchRefreshRequest, stream pb.Weixin_WatchRefreshServer) error {
+	sections := make(map[string]bool, len(req.GetSections()))
+	for _, name := range req.GetSections() {
+		if !manager().IsAccount(name) {
+			return grpcError(newWError(errNotFound, "section not found: "+name))
+		}
+		sections[name] = true
+	}
+
+	id, events := watchRefresh()
+	defer unwatchRefresh(id)
+
+	for {
+		select {
+		case ev := <-events:
+			if len(sections) > 0 && !sections[ev.section] {
+				continue
+			}
+			if err := stream.Send(&pb.RefreshEvent{Value: grpcValue(ev.section, ev.kind, ev.ticketType, ev.value)}); err != nil {
+				return err
+			}
+		case <-stream.Context().Done():
+			return nil
+		case <-s.quit:
+			return nil
+		}
+	}
+}
+
+func grpcPeer(ctx context.Context) string {
+	if p, ok := peer.FromContext(ctx); ok {
+		return p.Addr.String()
+	}
+	return ""
+}
+
+// grpcUnary 统计耗时并记录访问日志 请求中的section字段视为section
+func grpcUnary(ctx context.Context, req interface{}, info *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (interface{}, error) {
+	startAt := time.Now()
+	method := path.Base(info.FullMethod)
+
+	record := &accessRecord{result: "ok"}
+	if r, ok := req.(interface{ GetSection() string }); ok {
+		record.section = r.GetSection()
+	}
+
+	res, err := handler(context.WithValue(ctx, grpcRecordKey{}, record), req)
+	if err != nil {
+		record.fail(status.Code(err).String())
+	}
+
+	observeCommand("grpc", method, record.section, startAt)
+	writeAccess("grpc", grpcPeer(ctx), method, record, startAt)
+
+	return res, err
+}
+
+func grpcStream(srv interface{}, ss grpc.ServerStream, info *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+	startAt := time.Now()
+	method := path.Base(info.FullMethod)
+
+	record := &accessRecord{result: "ok"}
+	err := handler(srv, ss)
+	if err != nil {
+		record.fail(status.Code(err).String())
+	}
+
+	observeCommand("grpc", method, "", startAt)
+	writeAccess("grpc", grpcPeer(ss.Context()), method, record, startAt)
+
+	return err
+}
+
+func newGrpcServer(quit <-chan struct{}) *grpc.Server {
+	server := grpc.NewServer(
+		grpc.ChainUnaryInterceptor(grpcUnary),
+		grpc.ChainStreamInterceptor(grpcStream),
+	)
+	pb.RegisterWeixinServer(server, &grpcServer{quit: quit})
+
+	return server
+}
+
+// readyListener Serve开始接受连接时调用ready
+type readyListener struct {
+	net.Listener
+	once  sync.Once
+	ready func()
+}
+
+func (l *readyListener) Accept() (net.Conn, error) {
+	l.once.Do(l.ready)
+	return l.Listener.Accept()
+}
+
+// serveGrpc Serve开始接受连接后标记就绪 返回后清除
+func serveGrpc(server *grpc.Server, listener net.Listener) error {
+	defer grpcServing.Store(false)
+
+	return server.Serve(&readyListener{Listener: listener, ready: func() {
+		grpcServing.Store(true)
+	}})
+}
+
+func RunGrpcServer(ctx *common.ServerContext) {
+	defer ctx.Done()
+	ctx.Add()
+
+	listener, err := net.Listen("tcp", common.Config.GrpcAddress)
+	if err != nil {
+		common.Logger.Error("grpc server fail", "err", err)
+		ExitServer()
+		return
+	}
+
+	server := newGrpcServer(ctx.Quit())
+
+	go func() {
+		common.Logger.Info("run grpc server", "address", common.Config.GrpcAddress)
+		if err := serveGrpc(server, listener); err != nil {
+			common.Logger.Error("grpc server fail", "err", err)
+			ExitServer()
+		}
+	}()
+
+	select {
+	case <-ctx.Quit():
+		common.Logger.Info("grpc server catch exit signal")
+		server.GracefulStop()
+	}
+}
@@ -0,0 +1,212 @@
+package core
+
+import (
+	"context"
+	"google.golang.org/genproto/googleapis/rpc/errdetails"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"weixin/pb"
+	"weixin/wxtest"
+)
+
+// setupGrpc 在内存连接上启动grpc服务 结束后确认就绪标记已清除
+func setupGrpc(t *testing.T) pb.WeixinClient {
+	t.Helper()
+
+	setup(t)
+
+	listener := bufconn.Listen(1 << 20)
+	quit := make(chan struct{})
+	server := newGrpcServer(quit)
+	served := make(chan error, 1)
+	go func() { served <- serveGrpc(server, listener) }()
+
+	waitFor(t, "grpc serving", func() bool { return grpcServing.Load() })
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) { return listener.DialContext(ctx) }),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	t.Cleanup(func() {
+		conn.Close()
+		close(quit)
+		server.Stop()
+		if err := <-served; err != nil {
+			t.Errorf("serve = %v", err)
+		}
+		if grpcServing.Load() {
+			t.Error("grpc serving should be cleared after serve returned")
+		}
+	})
+
+	return pb.NewWeixinClient(conn)
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	t.Helper()
+
+	for i := 0; i < 100; i++ {
+		if cond() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("timeout waiting for %s", what)
+}
+
+func watcherCount() int {
+	refreshWatchers.Lock()
+	defer refreshWatchers.Unlock()
+
+	return len(refreshWatchers.watchers)
+}
+
+func expectGrpcError(t *testing.T, err error, code codes.Code, reason string) {
+	t.Helper()
+
+	st, ok := status.FromError(err)
+	if !ok || st.Code() != code {
+		t.Fatalf("err = %v, want %v", err, code)
+	}
+	for _, detail := range st.Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Reason == reason {
+			return
+		}
+	}
+	t.Fatalf("error info of %v, want reason %s", st.Details(), reason)
+}
+
+func TestGrpcGetToken(t *testing.T) {
+	client := setupGrpc(t)
+	ctx := context.Background()
+
+	v, err := client.GetToken(ctx, &pb.GetTokenRequest{Section: "gzh"})
+	if err != nil || v.GetValue() != fake.CurrentToken(testAppId) || v.GetSource() != sourceUpstream || v.GetKind() != kindToken || v.GetExpiresIn() <= 0 {
+		t.Fatalf("token = %v %v", v, err)
+	}
+	if cached, err := client.GetToken(ctx, &pb.GetTokenRequest{Section: "gzh"}); err != nil || cached.GetValue() != v.GetValue() || cached.GetSource() != sourceCache {
+		t.Fatalf("cached token = %v %v", cached, err)
+	}
+	if forced, err := client.GetToken(ctx, &pb.GetTokenRequest{Section: "gzh", Force: true}); err != nil || forced.GetValue() == v.GetValue() {
+		t.Fatalf("forced token = %v %v", forced, err)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	_, err = client.GetToken(ctx, &pb.GetTokenRequest{Section: "missing"})
+	expectGrpcError(t, err, codes.NotFound, errNotFound)
+}
+
+func TestGrpcGetTicket(t *testing.T) {
+	client := setupGrpc(t)
+	ctx := context.Background()
+
+	v, err := client.GetTicket(ctx, &pb.GetTicketRequest{Section: "gzh"})
+	if err != nil || !strings.HasPrefix(v.GetValue(), "TICKET_"+testAppId+"_JSAPI_") || v.GetType() != ticketJsapi {
+		t.Fatalf("ticket = %v %v", v, err)
+	}
+	if card, err := client.GetTicket(ctx, &pb.GetTicketRequest{Section: "gzh", Type: ticketWxCard}); err != nil || !strings.HasPrefix(card.GetValue(), "TICKET_"+testAppId+"_WX_CARD_") {
+		t.Fatalf("wx_card ticket = %v %v", card, err)
+	}
+
+	_, err = client.GetTicket(ctx, &pb.GetTicketRequest{Section: "gzh", Type: "unknown"})
+	expectGrpcError(t, err, codes.InvalidArgument, errInvalidType)
+}
+
+func TestGrpcSign(t *testing.T) {
+	client := setupGrpc(t)
+
+	res, err := client.Sign(context.Background(), &pb.SignRequest{Section: "gzh", Url: "https://example.com/", NonceStr: "nonce", Timestamp: 1700000000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want, err := Sign("gzh", "https://example.com/", "nonce", 1700000000)
+	if err != nil || res.GetSignature() != want.Signature || res.GetAppId() != testAppId {
+		t.Fatalf("sign = %v, want %v %v", res, want, err)
+	}
+}
+
+func TestGrpcListAccounts(t *testing.T) {
+	client := setupGrpc(t)
+
+	res, err := client.ListAccounts(context.Background(), &pb.ListAccountsRequest{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sections := make([]string, 0)
+	for _, account := range res.GetAccounts() {
+		sections = append(sections, account.GetSection())
+		if account.GetSecret() == "gzh_secret" || account.GetSecret() == "qy_secret" {
+			t.Fatalf("secret in account %v", account)
+		}
+	}
+	if len(sections) != 3 || sections[0] != "gzh" || sections[1] != "noid" || sections[2] != "qy" {
+		t.Fatalf("sections = %v", sections)
+	}
+}
+
+func TestGrpcWatchRefresh(t *testing.T) {
+	client := setupGrpc(t)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	stream, err := client.WatchRefresh(ctx, &pb.WatchRefreshRequest{Sections: []string{"gzh"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	waitFor(t, "watcher", func() bool { return watcherCount() == 1 })
+
+	//未订阅的section不推送
+	if _, err := GetToken("qy", true); err != nil {
+		t.Fatal(err)
+	}
+	token, err := GetToken("gzh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ev, err := stream.Recv()
+	if err != nil || ev.GetValue().GetSection() != "gzh" || ev.GetValue().GetKind() != kindToken || ev.GetValue().GetValue() != token.Value() {
+		t.Fatalf("event = %v %v", ev, err)
+	}
+
+	cancel()
+	if _, err := stream.Recv(); status.Code(err) != codes.Canceled {
+		t.Fatalf("recv after cancel = %v", err)
+	}
+	waitFor(t, "watcher removed", func() bool { return watcherCount() == 0 })
+
+	unknown, err := client.WatchRefresh(context.Background(), &pb.WatchRefreshRequest{Sections: []string{"missing"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = unknown.Recv()
+	expectGrpcError(t, err, codes.NotFound, errNotFound)
+}
+
+// 微信接口返回的errcode放入ErrorInfo
+func TestGrpcUpstreamError(t *testing.T) {
+	client := setupGrpc(t)
+
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrIPWhitelist))
+	_, err := client.GetToken(context.Background(), &pb.GetTokenRequest{Section: "gzh"})
+	expectGrpcError(t, err, codes.Unavailable, errUpstreamReject)
+
+	for _, detail := range status.Convert(err).Details() {
+		if info, ok := detail.(*errdetails.ErrorInfo); ok && info.Metadata["errcode"] != strconv.Itoa(wxtest.ErrIPWhitelist.ErrCode) {
+			t.Fatalf("error info = %v", info)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package core
+
+import (
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"sync/atomic"
+	"time"
+	"weixin/common"
+)
+
+var (
+	dataLoaded  atomic.Bool
+	webServing  atomic.Bool
+	respServing atomic.Bool
+	grpcServing atomic.Bool
+)
+
+type kindHealth struct {
+	Cached       bool   `json:"cached"`
+	ExpireAt     int64  `json:"expireAt"`
+	ExpiresIn    int64  `json:"expiresIn"`
+	RefreshAt    int64  `json:"refreshAt"`
+	RefreshCount int    `json:"refreshCount"`
+	LastError    string `json:"lastError"`
+	LastErrorAt  int64  `json:"lastErrorAt"`
+}
+
+type sectionHealth struct {
+	Critical bool        `json:"critical"`
+	Ready    bool        `json:"ready"`
+	Breaker  string      `json:"breaker"`
+	Token    *kindHealth `json:"token"`
+	Ticket   *kindHealth `json:"ticket"`
+}
+
+func unixOrZero(t time.Time) int64 {
+	if t.IsZero() {
+		return 0
+	}
+	return t.Unix()
+}
+
+func kindHealthOf(name, kind string, wxValue *WValues) *kindHealth {
+	status := manager().statusOf(name, kind)
+
+	kh := &kindHealth{
+		RefreshAt:    unixOrZero(status.RefreshAt),
+		RefreshCount: status.RefreshCount,
+		LastError:    status.LastError,
+		LastErrorAt:  unixOrZero(status.LastErrorAt),
+	}
+
+	if wxValue != nil {
+		kh.Cached = true
+		kh.ExpireAt = wxValue.expireAt.Unix()
+		kh.ExpiresIn = int64(time.Until(wxValue.expireAt).Seconds())
+	}
+
+	return kh
+}
+
+func isCritical(name string) bool {
+	for _, v := range common.Config.CriticalSections {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+// healthz 进程存活
+func healthz(c *gin.Context) {
+	c.JSON(http.StatusOK, gin.H{
+		"status":  "ok",
+		"version": common.VERSION,
+		"uptime":  int64(time.Since(runAtTime).Seconds()),
+	})
+}
+
+// readyz 数据已加载 监听正常 且critical_sections均持有未过期token
+func readyz(c *gin.Context) {
+	ready := dataLoaded.Load() && webServing.Load() && respServing.Load()
+	if len(common.Config.GrpcAddress) > 0 && !grpcServing.Load() {
+		ready = false
+	}
+
+	m := manager()
+	sections := make(map[string]*sectionHealth)
+	for _, name := range m.Accounts() {
+		values := m.values(m.AppId(name))
+
+		sh := &sectionHealth{
+			Critical: isCritical(name),
+			Ready:    values[kindToken] != nil,
+			Breaker:  m.BreakerState(name),
+			Token:    kindHealthOf(name, kindToken, values[kindToken]),
+			Ticket:   kindHealthOf(name, kindTicket, values[kindTicket]),
+		}
+		if sh.Critical && !sh.Ready {
+			ready = false
+		}
+
+		sections[name] = sh
+	}
+
+	for _, name := range common.Config.CriticalSections {
+		if !m.IsAccount(name) {
+			ready = false
+			sections[name] = &sectionHealth{Critical: true}
+		}
+	}
+
+	code := http.StatusOK
+	if !ready {
+		code = http.StatusServiceUnavailable
+	}
+
+	listeners := gin.H{
+		"web":   webServing.Load(),
+		"redis": respServing.Load(),
+	}
+	if len(common.Config.GrpcAddress) > 0 {
+		listeners["grpc"] = grpcServing.Load()
+	}
+
+	c.JSON(code, gin.H{
+		"ready":      ready,
+		"dataLoaded": dataLoaded.Load(),
+		"listeners":  listeners,
+		"sections":   sections,
+	})
+}
@@ -2,6 +2,7 @@ package core
 
 import (
 	"bytes"
+	"context"
 	"crypto/tls"
 	"encoding/json"
 	"encoding/xml"
@@ -19,10 +20,31 @@ import (
 	"time"
 )
 
-var defaultSetting = HttpSettings{false, "Server", 60 * time.Second, 60 * time.Second, nil, nil, nil, false}
+var defaultSetting = HttpSettings{
+	UserAgent:           "Server",
+	ConnectTimeout:      60 * time.Second,
+	ReadWriteTimeout:    60 * time.Second,
+	MaxIdleConnsPerHost: 4,
+	IdleConnTimeout:     90 * time.Second,
+}
 var defaultCookieJar http.CookieJar
 var settingMutex sync.Mutex
 
+// sharedTransport 未指定Transport,TlsClientConfig,Proxy及LocalAddr的请求共用 保持长连接
+var sharedTransport *http.Transport
+
+// transportKey 指定TlsClientConfig或LocalAddr的请求按设置共用Transport TlsClientConfig按指针区分
+type transportKey struct {
+	tlsConfig           *tls.Config
+	localAddr           string
+	connectTimeout      time.Duration
+	maxIdleConnsPerHost int
+	idleConnTimeout     time.Duration
+	disableHTTP2        bool
+}
+
+var customTransports = make(map[transportKey]*http.Transport)
+
 // createDefaultCookie creates a global cookiejar to store cookies.
 func createDefaultCookie() {
 	settingMutex.Lock()
@@ -41,6 +63,104 @@ func SetDefaultSetting(setting HttpSettings) {
 	if defaultSetting.ReadWriteTimeout == 0 {
 		defaultSetting.ReadWriteTimeout = 60 * time.Second
 	}
+	if defaultSetting.IdleConnTimeout == 0 {
+		defaultSetting.IdleConnTimeout = 90 * time.Second
+	}
+
+	if sharedTransport != nil {
+		sharedTransport.CloseIdleConnections()
+		sharedTransport = nil
+	}
+	for key, t := range customTransports {
+		t.CloseIdleConnections()
+		delete(customTransports, key)
+	}
+}
+
+// NewTransport 按setting创建可复用的Transport 连接空闲超过IdleConnTimeout后关闭
+func NewTransport(setting HttpSettings) *http.Transport {
+	dialer := &net.Dialer{
+		Timeout:   setting.ConnectTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	if setting.LocalAddr != nil {
+		dialer.LocalAddr = setting.LocalAddr
+	}
+
+	return &http.Transport{
+		TLSClientConfig:     setting.TlsClientConfig,
+		Proxy:               setting.Proxy,
+		DialContext:         dialer.DialContext,
+		TLSHandshakeTimeout: setting.ConnectTimeout,
+		MaxIdleConns:        100,
+		MaxIdleConnsPerHost: setting.MaxIdleConnsPerHost,
+		IdleConnTimeout:     setting.IdleConnTimeout,
+		ForceAttemptHTTP2:   !setting.DisableHTTP2,
+	}
+}
+
+// DefaultSetting 返回当前默认设置的副本
+func DefaultSetting() HttpSettings {
+	settingMutex.Lock()
+	defer settingMutex.Unlock()
+
+	return defaultSetting
+}
+
+func defaultTransport() *http.Transport {
+	settingMutex.Lock()
+	defer settingMutex.Unlock()
+
+	if sharedTransport == nil {
+		sharedTransport = NewTransport(defaultSetting)
+	}
+
+	return sharedTransport
+}
+
+// customTransport 返回与setting对应的共用Transport
+// Proxy为函数无法比较 每次创建且不保持连接 需要复用时通过SetTransport指定
+func customTransport(setting HttpSettings) *http.Transport {
+	if setting.Proxy != nil {
+		t := NewTransport(setting)
+		t.DisableKeepAlives = true
+		return t
+	}
+
+	key := transportKey{
+		tlsConfig:           setting.TlsClientConfig,
+		connectTimeout:      setting.ConnectTimeout,
+		maxIdleConnsPerHost: setting.MaxIdleConnsPerHost,
+		idleConnTimeout:     setting.IdleConnTimeout,
+		disableHTTP2:        setting.DisableHTTP2,
+	}
+	if setting.LocalAddr != nil {
+		key.localAddr = setting.LocalAddr.String()
+	}
+
+	settingMutex.Lock()
+	defer settingMutex.Unlock()
+
+	t, ok := customTransports[key]
+	if !ok {
+		t = NewTransport(setting)
+		customTransports[key] = t
+	}
+
+	return t
+}
+
+// CloseIdleConnections 关闭共用Transport的空闲连接
+func CloseIdleConnections() {
+	settingMutex.Lock()
+	defer settingMutex.Unlock()
+
+	if sharedTransport != nil {
+		sharedTransport.CloseIdleConnections()
+	}
+	for _, t := range customTransports {
+		t.CloseIdleConnections()
+	}
 }
 
 // return *HttpRequest with specific method
@@ -53,7 +173,7 @@ func newRequest(url, method string) *HttpRequest {
 		ProtoMajor: 1,
 		ProtoMinor: 1,
 	}
-	return &HttpRequest{url, &req, map[string]string{}, map[string]string{}, defaultSetting, &resp, nil}
+	return &HttpRequest{url, &req, map[string]string{}, map[string]string{}, DefaultSetting(), &resp, nil, context.Background()}
 }
 
 // Get returns *HttpRequest with GET method.
@@ -91,6 +211,14 @@ type HttpSettings struct {
 	Proxy            func(*http.Request) (*url.URL, error)
 	Transport        http.RoundTripper
 	EnableCookie     bool
+	// MaxIdleConnsPerHost 每个host保持的空闲连接数
+	MaxIdleConnsPerHost int
+	// IdleConnTimeout 空闲连接保持时间
+	IdleConnTimeout time.Duration
+	// DisableHTTP2 为true时只使用HTTP/1.1
+	DisableHTTP2 bool
+	// LocalAddr 非nil时从该地址发起连接
+	LocalAddr *net.TCPAddr
 }
 
 // HttpRequest provides more useful methods for requesting one url than http.Request.
@@ -102,6 +230,7 @@ type HttpRequest struct {
 	setting HttpSettings
 	resp    *http.Response
 	body    []byte
+	ctx     context.Context
 }
 
 // Change request settings
@@ -110,6 +239,12 @@ func (b *HttpRequest) Setting(setting HttpSettings) *HttpRequest {
 	return b
 }
 
+// SetContext sets the context of the request, canceling the context aborts the request.
+func (b *HttpRequest) SetContext(ctx context.Context) *HttpRequest {
+	b.ctx = ctx
+	return b
+}
+
 // SetBasicAuth sets the request's Authorization header to use HTTP Basic Authentication with the provided username and password.
 func (b *HttpRequest) SetBasicAuth(username, password string) *HttpRequest {
 	b.req.SetBasicAuth(username, password)
@@ -303,23 +438,23 @@ func (b *HttpRequest) getResponse() (*http.Response, error) {
 	trans := b.setting.Transport
 
 	if trans == nil {
-		// create default transport
-		trans = &http.Transport{
-			TLSClientConfig: b.setting.TlsClientConfig,
-			Proxy:           b.setting.Proxy,
-			Dial:            TimeoutDialer(b.setting.ConnectTimeout, b.setting.ReadWriteTimeout),
+		if b.setting.TlsClientConfig == nil && b.setting.Proxy == nil && b.setting.LocalAddr == nil {
+			trans = defaultTransport()
+		} else {
+			// reuse transport with custom tls config, proxy or local address
+			trans = customTransport(b.setting)
 		}
 	} else {
 		// if b.transport is *http.Transport then set the settings.
 		if t, ok := trans.(*http.Transport); ok {
-			if t.TLSClientConfig == nil {
+			if t.TLSClientConfig == nil && b.setting.TlsClientConfig != nil {
 				t.TLSClientConfig = b.setting.TlsClientConfig
 			}
-			if t.Proxy == nil {
+			if t.Proxy == nil && b.setting.Proxy != nil {
 				t.Proxy = b.setting.Proxy
 			}
-			if t.Dial == nil {
-				t.Dial = TimeoutDialer(b.setting.ConnectTimeout, b.setting.ReadWriteTimeout)
+			if t.Dial == nil && t.DialContext == nil {
+				t.DialContext = (&net.Dialer{Timeout: b.setting.ConnectTimeout, KeepAlive: 30 * time.Second}).DialContext
 			}
 		}
 	}
@@ -332,9 +467,11 @@ func (b *HttpRequest) getResponse() (*http.Response, error) {
 		jar = defaultCookieJar
 	}
 
+	// ReadWriteTimeout限制整个请求 连接本身不设置deadline以便复用
 	client := &http.Client{
 		Transport: trans,
 		Jar:       jar,
+		Timeout:   b.setting.ReadWriteTimeout,
 	}
 
 	if b.setting.UserAgent != "" && b.req.Header.Get("User-Agent") == "" {
@@ -349,7 +486,7 @@ func (b *HttpRequest) getResponse() (*http.Response, error) {
 		println(string(dump))
 	}
 
-	resp, err := client.Do(b.req)
+	resp, err := client.Do(b.req.WithContext(b.ctx))
 	if err != nil {
 		return nil, err
 	}
@@ -436,6 +573,7 @@ func (b *HttpRequest) Response() (*http.Response, error) {
 }
 
 // TimeoutDialer returns functions of connection dialer with timeout settings for http.Transport Dial field.
+// The read-write deadline is absolute, connections dialed by it should not be reused.
 func TimeoutDialer(cTimeout time.Duration, rwTimeout time.Duration) func(net, addr string) (c net.Conn, err error) {
 	return func(netw, addr string) (net.Conn, error) {
 		conn, err := net.DialTimeout(netw, addr, cTimeout)
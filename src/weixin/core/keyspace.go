@@ -0,0 +1,278 @@
+package core
+
+import (
+	"fmt"
+	"github.com/tidwall/redcon"
+	"path"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// virtualKey 虚拟键 token:{section} ticket:{section} ticket:{section}:wx_card
+type virtualKey struct {
+	kind       string
+	section    string
+	ticketType string
+}
+
+func parseVirtualKey(key string) (*virtualKey, bool) {
+	parts := strings.Split(key, ":")
+	if len(parts) < 2 || len(parts) > 3 || len(parts[1]) == 0 {
+		return nil, false
+	}
+
+	vk := &virtualKey{kind: parts[0], section: parts[1]}
+	switch {
+	case vk.kind == kindToken && len(parts) == 2:
+	case vk.kind == kindTicket && len(parts) == 2:
+		vk.ticketType = ticketJsapi
+	case vk.kind == kindTicket && (parts[2] == ticketJsapi || parts[2] == ticketWxCard):
+		vk.ticketType = parts[2]
+	default:
+		return nil, false
+	}
+
+	if !manager().IsAccount(vk.section) {
+		return nil, false
+	}
+
+	return vk, true
+}
+
+func (vk *virtualKey) String() string {
+	if vk.kind == kindTicket && vk.ticketType != ticketJsapi {
+		return vk.kind + ":" + vk.section + ":" + vk.ticketType
+	}
+	return vk.kind + ":" + vk.section
+}
+
+// fetch 读取值 缓存未命中时请求微信接口
+func (vk *virtualKey) fetch(conn redcon.Conn) (*WValues, error) {
+	record := respRecord(conn)
+	record.section = vk.section
+
+	client := clientOf(conn)
+	client.Lock()
+	client.tracking.remember(vk.String())
+	client.Unlock()
+
+	if vk.kind == kindToken {
+		wxValue, err := GetToken(vk.section, true)
+		record.track(kindToken, wxValue, true, err)
+		return wxValue, err
+	}
+
+	wxValue, err := GetTypedTicket(vk.section, vk.ticketType, true)
+	record.track(kindTicket, wxValue, true, err)
+	return wxValue, err
+}
+
+// cached 只读取缓存 用于TTL EXISTS等不触发刷新的命令
+func (vk *virtualKey) cached() *WValues {
+	m := manager()
+	appId := m.AppId(vk.section)
+	if vk.kind == kindToken {
+		return m.lookup(kindToken, appId)
+	}
+	return m.lookup(kindTicket, ticketKey(appId, vk.ticketType))
+}
+
+// cachedKeys 返回当前缓存中未过期的虚拟键
+func cachedKeys() []string {
+	keys := make([]string, 0)
+	for _, name := range manager().Accounts() {
+		candidates := []*virtualKey{
+			{kind: kindToken, section: name},
+			{kind: kindTicket, section: name, ticketType: ticketJsapi},
+			{kind: kindTicket, section: name, ticketType: ticketWxCard},
+		}
+		for _, vk := range candidates {
+			if vk.cached() != nil {
+				keys = append(keys, vk.String())
+			}
+		}
+	}
+	return keys
+}
+
+func matchKeys(keys []string, pattern string) []string {
+	matched := make([]string, 0, len(keys))
+	for _, key := range keys {
+		if ok, _ := path.Match(pattern, key); ok {
+			matched = append(matched, key)
+		}
+	}
+	return matched
+}
+
+// registerKeyspaceCommands 将token&ticket映射为只读字符串键 供只支持GET的缓存库使用
+// GET及MGET在缓存未命中时会请求微信接口 TTL EXISTS KEYS SCAN只反映当前缓存
+func registerKeyspaceCommands(rs *respServeMux) {
+	rs.Handle("get", handleCommand("get", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'get' command")
+			return
+		}
+
+		vk, ok := parseVirtualKey(string(cmd.Args[1]))
+		if !ok {
+			respRecord(conn).fail("unknown key")
+			conn.WriteNull()
+			return
+		}
+
+		wxValue, err := vk.fetch(conn)
+		if err != nil {
+			writeError(conn, err)
+			return
+		}
+		conn.WriteBulkString(wxValue.value)
+	}))
+	rs.Handle("mget", handleCommand("mget", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'mget' command")
+			return
+		}
+
+		conn.WriteArray(len(cmd.Args) - 1)
+		for _, arg := range cmd.Args[1:] {
+			vk, ok := parseVirtualKey(string(arg))
+			if !ok {
+				conn.WriteNull()
+				continue
+			}
+
+			wxValue, err := vk.fetch(conn)
+			if err != nil {
+				conn.WriteNull()
+				continue
+			}
+			conn.WriteBulkString(wxValue.value)
+		}
+		//多个键时不记录section
+		respRecord(conn).section = ""
+	}))
+	rs.Handle("ttl", handleCommand("ttl", func(conn redcon.Conn, cmd redcon.Command) {
+		writeTTL(conn, cmd, time.Second)
+	}))
+	rs.Handle("pttl", handleCommand("pttl", func(conn redcon.Conn, cmd redcon.Command) {
+		writeTTL(conn, cmd, time.Millisecond)
+	}))
+	rs.Handle("exists", handleCommand("exists", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'exists' command")
+			return
+		}
+
+		count := 0
+		for _, arg := range cmd.Args[1:] {
+			if vk, ok := parseVirtualKey(string(arg)); ok && vk.cached() != nil {
+				count++
+			}
+		}
+		conn.WriteInt(count)
+	}))
+	rs.Handle("type", handleCommand("type", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'type' command")
+			return
+		}
+
+		if vk, ok := parseVirtualKey(string(cmd.Args[1])); ok && vk.cached() != nil {
+			respRecord(conn).section = vk.section
+			conn.WriteString("string")
+			return
+		}
+		conn.WriteString("none")
+	}))
+	rs.Handle("dbsize", handleCommand("dbsize", func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteInt(len(cachedKeys()))
+	}))
+	rs.Handle("keys", handleCommand("keys", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'keys' command")
+			return
+		}
+
+		keys := matchKeys(cachedKeys(), string(cmd.Args[1]))
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	}))
+	//键数量很少 一次返回全部结果 游标总是0
+	rs.Handle("scan", handleCommand("scan", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) < 2 || len(cmd.Args)%2 != 0 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR wrong number of arguments for 'scan' command")
+			return
+		}
+
+		if _, err := strconv.ParseUint(string(cmd.Args[1]), 10, 64); err != nil {
+			conn.WriteError("ERR invalid cursor")
+			return
+		}
+
+		pattern := "*"
+		keyType := ""
+		for i := 2; i < len(cmd.Args); i += 2 {
+			value := string(cmd.Args[i+1])
+			switch strings.ToLower(string(cmd.Args[i])) {
+			case "match":
+				pattern = value
+			case "count":
+				if _, err := strconv.Atoi(value); err != nil {
+					conn.WriteError("ERR value is not an integer or out of range")
+					return
+				}
+			case "type":
+				keyType = strings.ToLower(value)
+			default:
+				conn.WriteError("ERR syntax error")
+				return
+			}
+		}
+
+		keys := matchKeys(cachedKeys(), pattern)
+		if len(keyType) > 0 && keyType != "string" {
+			keys = keys[:0]
+		}
+
+		conn.WriteArray(2)
+		conn.WriteBulkString("0")
+		conn.WriteArray(len(keys))
+		for _, key := range keys {
+			conn.WriteBulkString(key)
+		}
+	}))
+}
+
+func writeTTL(conn redcon.Conn, cmd redcon.Command, unit time.Duration) {
+	if len(cmd.Args) != 2 {
+		respRecord(conn).fail("invalid args")
+		conn.WriteError(fmt.Sprintf("ERR wrong number of arguments for '%s' command", strings.ToLower(string(cmd.Args[0]))))
+		return
+	}
+
+	vk, ok := parseVirtualKey(string(cmd.Args[1]))
+	if !ok {
+		conn.WriteInt(-2)
+		return
+	}
+
+	respRecord(conn).section = vk.section
+
+	wxValue := vk.cached()
+	if wxValue == nil {
+		conn.WriteInt(-2)
+		return
+	}
+
+	conn.WriteInt64(int64(time.Until(wxValue.expireAt) / unit))
+}
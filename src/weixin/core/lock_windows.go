@@ -0,0 +1,14 @@
+//go:build windows
+
+package core
+
+import (
+	"golang.org/x/sys/windows"
+	"os"
+)
+
+// lockFile 对文件加排他锁 已被其他进程持有时立即返回错误
+func lockFile(f *os.File) error {
+	ol := new(windows.Overlapped)
+	return windows.LockFileEx(windows.Handle(f.Fd()), windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, ol)
+}
@@ -0,0 +1,142 @@
+package core
+
+import (
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+// INFO命令使用的缓存命中统计
+var cacheHits, cacheMisses atomic.Int64
+
+var (
+	metricCacheRequests = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "weixin",
+		Name:      "cache_requests_total",
+		Help:      "Token and ticket lookups by cache result.",
+	}, []string{"section", "kind", "result"})
+
+	metricUpstreamDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "weixin",
+		Name:      "upstream_duration_seconds",
+		Help:      "Latency of weixin token and ticket api calls.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"section", "kind"})
+
+	metricUpstreamFailures = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "weixin",
+		Name:      "upstream_failures_total",
+		Help:      "Failed weixin token and ticket api calls by errcode, -1 when the request itself failed.",
+	}, []string{"section", "kind", "errcode"})
+
+	metricUpstreamRetries = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: "weixin",
+		Name:      "upstream_retries_total",
+		Help:      "Retried weixin token and ticket api calls.",
+	}, []string{"section", "kind"})
+
+	metricSaveDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "weixin",
+		Name:      "save_duration_seconds",
+		Help:      "Latency of persisting the cache to storage.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"storage", "result"})
+
+	metricCommands = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: "weixin",
+		Name:      "command_duration_seconds",
+		Help:      "Latency of resp commands and http routes.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"protocol", "command", "section"})
+)
+
+func init() {
+	prometheus.MustRegister(
+		metricCacheRequests,
+		metricUpstreamDuration,
+		metricUpstreamFailures,
+		metricUpstreamRetries,
+		metricSaveDuration,
+		metricCommands,
+	)
+}
+
+const metricUnknown = "unknown"
+
+// metricSection 未配置的section统一记为unknown 避免标签无限增长
+func metricSection(name string) string {
+	if manager().IsAccount(name) {
+		return name
+	}
+	return metricUnknown
+}
+
+// observeCache result为hit,miss,shared(集群共享值)或invalid(配置错误)
+func observeCache(wi *WItem, kind, result string) {
+	metricCacheRequests.WithLabelValues(wi.Name, kind, result).Inc()
+
+	switch result {
+	case "hit":
+		cacheHits.Add(1)
+	case "miss":
+		cacheMisses.Add(1)
+	}
+}
+
+func observeUpstream(wi *WItem, kind string, startAt time.Time) {
+	metricUpstreamDuration.WithLabelValues(wi.Name, kind).Observe(time.Since(startAt).Seconds())
+}
+
+func observeUpstreamFailure(wi *WItem, kind string, errCode int) {
+	metricUpstreamFailures.WithLabelValues(wi.Name, kind, strconv.Itoa(errCode)).Inc()
+}
+
+func observeUpstreamRetry(wi *WItem, kind string) {
+	metricUpstreamRetries.WithLabelValues(wi.Name, kind).Inc()
+}
+
+func observeSave(storage string, startAt time.Time, err error) {
+	result := "ok"
+	if err != nil {
+		result = "fail"
+	}
+	metricSaveDuration.WithLabelValues(storage, result).Observe(time.Since(startAt).Seconds())
+}
+
+func observeCommand(protocol, command, section string, startAt time.Time) {
+	if len(section) > 0 {
+		section = metricSection(section)
+	}
+	metricCommands.WithLabelValues(protocol, command, section).Observe(time.Since(startAt).Seconds())
+}
+
+func metricsHandler() http.Handler {
+	return promhttp.Handler()
+}
+
+var metricExpireDesc = prometheus.NewDesc(
+	"weixin_expire_seconds",
+	"Seconds until the cached token or ticket of a section expires.",
+	[]string{"section", "kind"},
+	nil,
+)
+
+// expireCollector 抓取时计算Manager中各section缓存剩余有效期
+type expireCollector struct {
+	m *Manager
+}
+
+func (e *expireCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- metricExpireDesc
+}
+
+func (e *expireCollector) Collect(ch chan<- prometheus.Metric) {
+	for _, name := range e.m.Accounts() {
+		for kind, wxValue := range e.m.values(e.m.AppId(name)) {
+			ch <- prometheus.MustNewConstMetric(metricExpireDesc, prometheus.GaugeValue, time.Until(wxValue.expireAt).Seconds(), name, kind)
+		}
+	}
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"context"
+	"github.com/prometheus/client_golang/prometheus"
+	"net/http"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+	"weixin/wxtest"
+)
+
+// 只调用NewManager时在指定的Registerer上注册 不依赖全局Manager
+func TestManagerRegisterer(t *testing.T) {
+	registry := prometheus.NewRegistry()
+	m, err := NewManager(ManagerConfig{
+		Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+		Registerer: registry,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store(kindToken, testAppId, &WValues{value: "TOKEN", expireAt: time.Now().Add(time.Hour)})
+
+	families, err := registry.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(families) != 1 || families[0].GetName() != "weixin_expire_seconds" || len(families[0].GetMetric()) != 1 {
+		t.Fatalf("families = %v", families)
+	}
+
+	m.Close()
+	if families, _ := registry.Gather(); len(families) != 0 {
+		t.Fatalf("collector should be unregistered after close: %v", families)
+	}
+}
+
+// scrapeMetrics 抓取/metrics 返回各样本的值 key为名称及标签
+func scrapeMetrics(t *testing.T) map[string]float64 {
+	t.Helper()
+
+	code, body := httpDo(t, http.MethodGet, "/metrics", "")
+	if code != http.StatusOK {
+		t.Fatalf("metrics status = %d", code)
+	}
+
+	samples := make(map[string]float64)
+	for _, line := range strings.Split(body, "\n") {
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndex(line, " ")
+		v, err := strconv.ParseFloat(line[i+1:], 64)
+		if err != nil {
+			t.Fatalf("parse %q: %v", line, err)
+		}
+		samples[line[:i]] = v
+	}
+
+	return samples
+}
+
+func TestMetricsScrape(t *testing.T) {
+	rc := setup(t)
+
+	m, err := NewManager(ManagerConfig{
+		Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+		HTTPClient: fake.Client(),
+		OnChange:   valueChanged,
+		Registerer: prometheus.DefaultRegisterer,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(m.Close)
+	wx.Store(m)
+
+	before := scrapeMetrics(t)
+
+	do(t, rc, "token", "gzh")
+	do(t, rc, "token", "gzh")
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrApiLimit))
+	rc.Do(context.Background(), "token", "gzh", "1")
+
+	after := scrapeMetrics(t)
+	deltas := map[string]float64{
+		`weixin_cache_requests_total{kind="token",result="hit",section="gzh"}`:                 1,
+		`weixin_cache_requests_total{kind="token",result="miss",section="gzh"}`:                2,
+		`weixin_upstream_duration_seconds_count{kind="token",section="gzh"}`:                   2,
+		`weixin_upstream_failures_total{errcode="45009",kind="token",section="gzh"}`:           1,
+		`weixin_command_duration_seconds_count{command="token",protocol="resp",section="gzh"}`: 3,
+	}
+	for key, want := range deltas {
+		if got := after[key] - before[key]; got != want {
+			t.Errorf("%s delta = %v, want %v", key, got, want)
+		}
+	}
+
+	expire := after[`weixin_expire_seconds{kind="token",section="gzh"}`]
+	if expire <= 0 || expire > 7200 {
+		t.Errorf("expire seconds = %v", expire)
+	}
+}
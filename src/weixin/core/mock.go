@@ -0,0 +1,195 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/tidwall/redcon"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const mockExpiresIn = 7200
+
+// MockOptions mode=mock时不请求微信接口 生成确定性的token和ticket
+type MockOptions struct {
+	// ExpiresIn 有效期(秒) 默认7200
+	ExpiresIn int
+	// ErrCode 非0时每次刷新均返回该错误
+	ErrCode int
+	ErrMsg  string
+}
+
+// MockFailure 注入的失败 Unreachable模拟网络不可达 否则返回ErrCode及ErrMsg
+type MockFailure struct {
+	ErrCode     int
+	ErrMsg      string
+	Unreachable bool
+}
+
+type mockInjection struct {
+	failure MockFailure
+	count   int
+}
+
+// mocker 按appId递增序号生成token和ticket 重启后从1开始
+type mocker struct {
+	sync.Mutex
+	seq        map[string]int
+	tokens     map[string]string
+	injections map[string]*mockInjection
+}
+
+func newMocker() *mocker {
+	return &mocker{
+		seq:        make(map[string]int),
+		tokens:     make(map[string]string),
+		injections: make(map[string]*mockInjection),
+	}
+}
+
+// inject 之后count次刷新返回failure count为0时清除
+func (k *mocker) inject(name string, failure MockFailure, count int) {
+	k.Lock()
+	defer k.Unlock()
+
+	if count <= 0 {
+		delete(k.injections, name)
+		return
+	}
+
+	k.injections[name] = &mockInjection{failure: failure, count: count}
+}
+
+func (k *mocker) injected(name string) (MockFailure, bool) {
+	k.Lock()
+	defer k.Unlock()
+
+	injection, ok := k.injections[name]
+	if !ok {
+		return MockFailure{}, false
+	}
+
+	injection.count--
+	if injection.count <= 0 {
+		delete(k.injections, name)
+	}
+
+	return injection.failure, true
+}
+
+// respond 生成与微信接口格式一致的响应 ticket请求需携带最近生成的token
+func (k *mocker) respond(wi *WItem, kind, apiUrl string) ([]byte, error) {
+	if failure, ok := k.injected(wi.Name); ok {
+		if failure.Unreachable {
+			return nil, errors.New("mock upstream unreachable")
+		}
+		return json.Marshal(WResponse{ErrorCode: failure.ErrCode, ErrorMsg: failure.ErrMsg})
+	}
+
+	if wi.Mock.ErrCode != 0 {
+		errMsg := wi.Mock.ErrMsg
+		if len(errMsg) == 0 {
+			errMsg = fmt.Sprintf("mock errcode %d", wi.Mock.ErrCode)
+		}
+		return json.Marshal(WResponse{ErrorCode: wi.Mock.ErrCode, ErrorMsg: errMsg})
+	}
+
+	expiresIn := wi.Mock.ExpiresIn
+	if expiresIn <= 0 {
+		expiresIn = mockExpiresIn
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.seq[wi.AppId]++
+	n := k.seq[wi.AppId]
+
+	if kind == kindToken {
+		token := fmt.Sprintf("MOCK_TOKEN_%s_%d", wi.AppId, n)
+		k.tokens[wi.AppId] = token
+		return json.Marshal(WResponse{AccessToken: token, ExpiresIn: expiresIn})
+	}
+
+	u, err := url.Parse(apiUrl)
+	if err != nil {
+		return nil, err
+	}
+	//重启后尚未生成token时接受从存储加载的token
+	if latest, ok := k.tokens[wi.AppId]; ok && u.Query().Get("access_token") != latest {
+		return json.Marshal(WResponse{ErrorCode: 40001, ErrorMsg: "invalid credential, access_token is invalid or not latest"})
+	}
+
+	ticket := fmt.Sprintf("MOCK_TICKET_%s_%s_%d", wi.AppId, strings.ToUpper(ticketType(wi)), n)
+	return json.Marshal(WResponse{Ticket: ticket, ExpiresIn: expiresIn})
+}
+
+// MockFail mode=mock的section之后count次刷新返回failure count为0时清除
+func (m *Manager) MockFail(name string, failure MockFailure, count int) error {
+	account, ok := m.accounts[name]
+	if !ok {
+		return newWError(errNotFound, fmt.Sprintf("ERR not found match gzh config with %v", name))
+	}
+	if account.Mock == nil {
+		return newWError(errInvalidArgument, fmt.Sprintf("ERR %v is not in mock mode", name))
+	}
+
+	m.mock.inject(name, failure, count)
+
+	return nil
+}
+
+// mockEnabled 是否存在mode=mock的section
+func (m *Manager) mockEnabled() bool {
+	for _, account := range m.accounts {
+		if account.Mock != nil {
+			return true
+		}
+	}
+	return false
+}
+
+// handleMockFail MOCKFAIL section errcode|unreachable [count] count默认为1 为0时清除
+func handleMockFail(conn redcon.Conn, cmd redcon.Command) {
+	if len(cmd.Args) < 3 || len(cmd.Args) > 4 {
+		respRecord(conn).fail("invalid args")
+		conn.WriteError("ERR wrong number of arguments for 'mockfail' command")
+		return
+	}
+
+	var failure MockFailure
+	if strings.EqualFold(string(cmd.Args[2]), "unreachable") {
+		failure.Unreachable = true
+	} else {
+		errCode, err := strconv.Atoi(string(cmd.Args[2]))
+		if err != nil || errCode == 0 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR errcode is not a non-zero integer or unreachable")
+			return
+		}
+		failure.ErrCode = errCode
+		failure.ErrMsg = fmt.Sprintf("mock errcode %d", errCode)
+	}
+
+	count := 1
+	if len(cmd.Args) == 4 {
+		n, err := strconv.Atoi(string(cmd.Args[3]))
+		if err != nil || n < 0 {
+			respRecord(conn).fail("invalid args")
+			conn.WriteError("ERR count is not a non-negative integer")
+			return
+		}
+		count = n
+	}
+
+	if err := manager().MockFail(string(cmd.Args[1]), failure, count); err != nil {
+		respRecord(conn).fail(err.Error())
+		writeError(conn, err)
+		return
+	}
+
+	conn.WriteString("OK")
+}
@@ -0,0 +1,456 @@
+package core
+
+import (
+	"fmt"
+	"github.com/tidwall/redcon"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+	"weixin/common"
+)
+
+// respClient RESP连接上下文
+type respClient struct {
+	sync.Mutex
+	id          int64
+	dconn       redcon.DetachedConn
+	proto       int
+	addr        string
+	name        string
+	libName     string
+	libVer      string
+	db          int
+	createdAt   time.Time
+	lastCommand atomic.Value
+	lastAt      atomic.Int64
+	access      *accessRecord
+	tracking    clientTracking
+}
+
+var respClients = struct {
+	sync.Mutex
+	seq int64
+	m   map[int64]*respClient
+}{m: make(map[int64]*respClient)}
+
+var totalCommands atomic.Int64
+
+func clientOf(conn redcon.Conn) *respClient {
+	if client, ok := conn.Context().(*respClient); ok {
+		return client
+	}
+
+	client := newRespClient(conn)
+	conn.SetContext(client)
+
+	return client
+}
+
+func newRespClient(conn redcon.Conn) *respClient {
+	respClients.Lock()
+	defer respClients.Unlock()
+
+	respClients.seq++
+	client := &respClient{
+		id:        respClients.seq,
+		proto:     2,
+		addr:      conn.RemoteAddr(),
+		createdAt: time.Now(),
+	}
+	respClients.m[client.id] = client
+
+	return client
+}
+
+func connectedClients() int {
+	respClients.Lock()
+	defer respClients.Unlock()
+
+	return len(respClients.m)
+}
+
+func acceptClient(conn redcon.Conn) bool {
+	conn.SetContext(newRespClient(conn))
+	return true
+}
+
+func closeClient(conn redcon.Conn, err error) {
+	//脱离redcon时连接仍在使用 由serveDetached结束时关闭
+	if err != nil && err.Error() == "detached" {
+		return
+	}
+
+	if client, ok := conn.Context().(*respClient); ok {
+		respClients.Lock()
+		delete(respClients.m, client.id)
+		respClients.Unlock()
+	}
+}
+
+func (c *respClient) info() string {
+	c.Lock()
+	defer c.Unlock()
+
+	lastCommand, _ := c.lastCommand.Load().(string)
+	return fmt.Sprintf("id=%d addr=%s laddr=%s fd=0 name=%s age=%d idle=%d db=%d cmd=%s resp=%d tracking=%v lib-name=%s lib-ver=%s",
+		c.id,
+		c.addr,
+		common.Config.RedisAddress,
+		c.name,
+		int64(time.Since(c.createdAt).Seconds()),
+		time.Now().Unix()-c.lastAt.Load(),
+		c.db,
+		lastCommand,
+		c.proto,
+		c.tracking.enabled,
+		c.libName,
+		c.libVer,
+	)
+}
+
+// writeError 错误回复统一以ERR开头 与redis一致 客户端据此识别错误类型
+func writeError(conn redcon.Conn, err error) {
+	message := err.Error()
+	if !strings.HasPrefix(message, "ERR ") {
+		message = "ERR " + message
+	}
+	conn.WriteError(message)
+}
+
+// writeMap RESP3下输出map类型 RESP2下按key,value平铺为数组
+func writeMap(conn redcon.Conn, proto int, pairs ...interface{}) {
+	if proto >= 3 {
+		conn.WriteRaw([]byte(fmt.Sprintf("%%%d\r\n", len(pairs)/2)))
+	} else {
+		conn.WriteArray(len(pairs))
+	}
+	for _, v := range pairs {
+		conn.WriteAny(v)
+	}
+}
+
+// registerRespCommands 注册标准redis客户端连接时常用的命令
+func registerRespCommands(rs *respServeMux) {
+	rs.Accept(acceptClient)
+	rs.Closed(closeClient)
+
+	startTracking()
+
+	rs.Handle("ping", handleCommand("ping", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) >= 2 {
+			conn.WriteBulk(cmd.Args[1])
+			return
+		}
+		conn.WriteString("PONG")
+	}))
+	rs.Handle("echo", handleCommand("echo", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'echo' command")
+			return
+		}
+		conn.WriteBulk(cmd.Args[1])
+	}))
+	rs.Handle("quit", handleCommand("quit", func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteString("OK")
+		conn.Close()
+	}))
+	//未设置密码 任意认证均通过
+	rs.Handle("auth", handleCommand("auth", func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteString("OK")
+	}))
+	//只有一个虚拟库 接受任意库号以兼容连接池配置
+	rs.Handle("select", handleCommand("select", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) != 2 {
+			conn.WriteError("ERR wrong number of arguments for 'select' command")
+			return
+		}
+		db, err := strconv.Atoi(string(cmd.Args[1]))
+		if err != nil || db < 0 {
+			conn.WriteError("ERR value is not an integer or out of range")
+			return
+		}
+		client := clientOf(conn)
+		client.Lock()
+		client.db = db
+		client.Unlock()
+		conn.WriteString("OK")
+	}))
+	rs.Handle("hello", handleCommand("hello", func(conn redcon.Conn, cmd redcon.Command) {
+		client := clientOf(conn)
+
+		client.Lock()
+		protover := client.proto
+		client.Unlock()
+
+		args := cmd.Args[1:]
+		if len(args) > 0 {
+			var err error
+			protover, err = strconv.Atoi(string(args[0]))
+			if err != nil {
+				conn.WriteError("ERR Protocol version is not an integer or out of range")
+				return
+			}
+			if protover != 2 && protover != 3 {
+				conn.WriteError("NOPROTO unsupported protocol version")
+				return
+			}
+			args = args[1:]
+		}
+
+		for len(args) > 0 {
+			switch strings.ToLower(string(args[0])) {
+			case "auth":
+				if len(args) < 3 {
+					conn.WriteError("ERR syntax error in HELLO option 'auth'")
+					return
+				}
+				args = args[3:]
+			case "setname":
+				if len(args) < 2 {
+					conn.WriteError("ERR syntax error in HELLO option 'setname'")
+					return
+				}
+				client.Lock()
+				client.name = string(args[1])
+				client.Unlock()
+				args = args[2:]
+			default:
+				conn.WriteError(fmt.Sprintf("ERR syntax error in HELLO option '%s'", args[0]))
+				return
+			}
+		}
+
+		client.Lock()
+		client.proto = protover
+		if protover < 3 {
+			//RESP2无法接收推送消息
+			client.tracking = clientTracking{keys: make(map[string]bool), busy: client.tracking.busy}
+		}
+		client.Unlock()
+
+		writeMap(conn, protover,
+			"server", "redis",
+			"version", common.VERSION,
+			"proto", redcon.SimpleInt(protover),
+			"id", redcon.SimpleInt(client.id),
+			"mode", "standalone",
+			"role", "master",
+			"modules", []interface{}{},
+		)
+	}))
+	rs.Handle("client", handleCommand("client", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) < 2 {
+			conn.WriteError("ERR wrong number of arguments for 'client' command")
+			return
+		}
+
+		client := clientOf(conn)
+
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "setname":
+			if len(cmd.Args) != 3 {
+				conn.WriteError("ERR wrong number of arguments for 'client|setname' command")
+				return
+			}
+			client.Lock()
+			client.name = string(cmd.Args[2])
+			client.Unlock()
+			conn.WriteString("OK")
+		case "getname":
+			client.Lock()
+			name := client.name
+			client.Unlock()
+			if len(name) == 0 {
+				conn.WriteNull()
+				return
+			}
+			conn.WriteBulkString(name)
+		case "id":
+			conn.WriteInt64(client.id)
+		case "setinfo":
+			if len(cmd.Args) != 4 {
+				conn.WriteError("ERR wrong number of arguments for 'client|setinfo' command")
+				return
+			}
+			client.Lock()
+			switch strings.ToLower(string(cmd.Args[2])) {
+			case "lib-name":
+				client.libName = string(cmd.Args[3])
+			case "lib-ver":
+				client.libVer = string(cmd.Args[3])
+			default:
+				client.Unlock()
+				conn.WriteError(fmt.Sprintf("ERR Unrecognized option '%s'", cmd.Args[2]))
+				return
+			}
+			client.Unlock()
+			conn.WriteString("OK")
+		case "info":
+			conn.WriteBulkString(client.info() + "\n")
+		case "tracking":
+			if err := client.setTracking(lowerArgs(cmd.Args[2:])); err != nil {
+				writeError(conn, err)
+				return
+			}
+			conn.WriteString("OK")
+		case "trackinginfo":
+			client.Lock()
+			proto := client.proto
+			client.Unlock()
+			writeMap(conn, proto, client.trackingInfo()...)
+		case "caching":
+			//不支持OPTIN及OPTOUT 接受后忽略
+			conn.WriteString("OK")
+		case "list":
+			respClients.Lock()
+			clients := make([]*respClient, 0, len(respClients.m))
+			for _, c := range respClients.m {
+				clients = append(clients, c)
+			}
+			respClients.Unlock()
+
+			sort.Slice(clients, func(i, j int) bool {
+				return clients[i].id < clients[j].id
+			})
+
+			var sb strings.Builder
+			for _, c := range clients {
+				sb.WriteString(c.info())
+				sb.WriteString("\n")
+			}
+			conn.WriteBulkString(sb.String())
+		default:
+			conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", cmd.Args[1]))
+		}
+	}))
+	rs.Handle("command", handleCommand("command", func(conn redcon.Conn, cmd redcon.Command) {
+		if len(cmd.Args) == 1 {
+			writeCommandInfos(conn, respCommandNames())
+			return
+		}
+
+		switch strings.ToLower(string(cmd.Args[1])) {
+		case "count":
+			conn.WriteInt(len(respCommandNames()))
+		case "docs":
+			//不提供文档 返回空结果
+			conn.WriteArray(0)
+		case "info":
+			writeCommandInfos(conn, lowerArgs(cmd.Args[2:]))
+		case "list":
+			names := respCommandNames()
+			conn.WriteArray(len(names))
+			for _, name := range names {
+				conn.WriteBulkString(name)
+			}
+		default:
+			conn.WriteError(fmt.Sprintf("ERR unknown subcommand '%s'", cmd.Args[1]))
+		}
+	}))
+	rs.Handle("info", handleCommand("info", func(conn redcon.Conn, cmd redcon.Command) {
+		conn.WriteBulkString(respInfo(lowerArgs(cmd.Args[1:])))
+	}))
+}
+
+func lowerArgs(args [][]byte) []string {
+	values := make([]string, 0, len(args))
+	for _, arg := range args {
+		values = append(values, strings.ToLower(string(arg)))
+	}
+	return values
+}
+
+// 经handleCommand注册的命令名称 用于COMMAND
+var respCommands []string
+
+func respCommandNames() []string {
+	names := append([]string(nil), respCommands...)
+	sort.Strings(names)
+	return names
+}
+
+// writeCommandInfos COMMAND INFO 返回name,arity,flags,first key,last key,step
+func writeCommandInfos(conn redcon.Conn, names []string) {
+	conn.WriteArray(len(names))
+	for _, name := range names {
+		if !isRespCommand(name) {
+			conn.WriteNull()
+			continue
+		}
+		conn.WriteArray(6)
+		conn.WriteBulkString(name)
+		conn.WriteInt(-1)
+		conn.WriteArray(0)
+		conn.WriteInt(0)
+		conn.WriteInt(0)
+		conn.WriteInt(0)
+	}
+}
+
+func isRespCommand(name string) bool {
+	for _, v := range respCommands {
+		if v == name {
+			return true
+		}
+	}
+	return false
+}
+
+func respInfo(sections []string) string {
+	all := len(sections) == 0
+	want := func(name string) bool {
+		if all {
+			return true
+		}
+		for _, v := range sections {
+			if v == name || v == "all" || v == "everything" || v == "default" {
+				return true
+			}
+		}
+		return false
+	}
+
+	_, port, _ := net.SplitHostPort(common.Config.RedisAddress)
+	uptime := int64(time.Since(runAtTime).Seconds())
+	m := manager()
+	tokens, tickets := m.cachedCount()
+
+	var sb strings.Builder
+	if want("server") {
+		sb.WriteString("# Server\r\n")
+		sb.WriteString("redis_version:7.0.0\r\n")
+		sb.WriteString("redis_mode:standalone\r\n")
+		sb.WriteString(fmt.Sprintf("goredisweixin_version:%s\r\n", common.VERSION))
+		sb.WriteString(fmt.Sprintf("process_id:%d\r\n", PID))
+		sb.WriteString(fmt.Sprintf("tcp_port:%s\r\n", port))
+		sb.WriteString(fmt.Sprintf("uptime_in_seconds:%d\r\n", uptime))
+		sb.WriteString(fmt.Sprintf("uptime_in_days:%d\r\n", uptime/86400))
+		sb.WriteString("\r\n")
+	}
+	if want("clients") {
+		sb.WriteString("# Clients\r\n")
+		sb.WriteString(fmt.Sprintf("connected_clients:%d\r\n", connectedClients()))
+		sb.WriteString("\r\n")
+	}
+	if want("stats") {
+		sb.WriteString("# Stats\r\n")
+		sb.WriteString(fmt.Sprintf("total_commands_processed:%d\r\n", totalCommands.Load()))
+		sb.WriteString(fmt.Sprintf("cache_hits:%d\r\n", cacheHits.Load()))
+		sb.WriteString(fmt.Sprintf("cache_misses:%d\r\n", cacheMisses.Load()))
+		sb.WriteString("\r\n")
+	}
+	if want("weixin") {
+		sb.WriteString("# Weixin\r\n")
+		sb.WriteString(fmt.Sprintf("accounts:%d\r\n", len(m.Accounts())))
+		sb.WriteString(fmt.Sprintf("cached_tokens:%d\r\n", tokens))
+		sb.WriteString(fmt.Sprintf("cached_tickets:%d\r\n", tickets))
+		sb.WriteString(fmt.Sprintf("open_breakers:%d\r\n", m.openBreakers()))
+		sb.WriteString("\r\n")
+	}
+
+	return sb.String()
+}
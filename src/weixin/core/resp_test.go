@@ -0,0 +1,163 @@
+package core
+
+import (
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// readType 读取一条消息并返回其RESP类型 如'*'为RESP2数组 '%'为RESP3 map
+func (c *respConn) readType(t *testing.T) (byte, string) {
+	t.Helper()
+
+	prefix, err := c.rd.Peek(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	kind := prefix[0]
+
+	return kind, c.read(t)
+}
+
+func expectContains(t *testing.T, got string, wants ...string) {
+	t.Helper()
+
+	for _, want := range wants {
+		if !strings.Contains(got, want) {
+			t.Fatalf("%q not contains %q", got, want)
+		}
+	}
+}
+
+func TestRespHello(t *testing.T) {
+	setup(t)
+	c := dialResp(t)
+
+	c.send(t, "HELLO")
+	if kind, hello := c.readType(t); kind != '*' || !strings.HasPrefix(hello, "[server redis version ") {
+		t.Fatalf("hello = %c %s", kind, hello)
+	} else {
+		expectContains(t, hello, "proto 2", "mode standalone", "role master", "modules []")
+	}
+
+	c.send(t, "HELLO 3 SETNAME app", "CLIENT GETNAME")
+	if kind, hello := c.readType(t); kind != '%' {
+		t.Fatalf("hello 3 = %c %s", kind, hello)
+	} else {
+		expectContains(t, hello, "proto 3")
+	}
+	c.expect(t, "app")
+
+	c.send(t, "HELLO 4", "HELLO x", "HELLO 3 AUTH user", "HELLO 3 NOSUCH")
+	c.expect(t, "NOPROTO unsupported protocol version")
+	c.expect(t, "ERR Protocol version is not an integer or out of range")
+	c.expect(t, "ERR syntax error in HELLO option 'auth'")
+	c.expect(t, "ERR syntax error in HELLO option 'NOSUCH'")
+
+	//错误的HELLO不改变协议版本
+	c.send(t, "CLIENT TRACKINGINFO", "HELLO 2", "CLIENT TRACKINGINFO")
+	if kind, _ := c.readType(t); kind != '%' {
+		t.Fatalf("trackinginfo after failed hello = %c", kind)
+	}
+	if kind, hello := c.readType(t); kind != '*' {
+		t.Fatalf("hello 2 = %c %s", kind, hello)
+	}
+	if kind, info := c.readType(t); kind != '*' || !strings.HasPrefix(info, "[flags [off]") {
+		t.Fatalf("trackinginfo = %c %s", kind, info)
+	}
+}
+
+func TestRespClient(t *testing.T) {
+	setup(t)
+	c := dialResp(t)
+
+	c.send(t, "CLIENT ID")
+	id := c.read(t)
+	if _, err := strconv.ParseInt(id, 10, 64); err != nil {
+		t.Fatalf("client id = %q", id)
+	}
+
+	c.send(t, "CLIENT GETNAME", "CLIENT SETNAME worker", "CLIENT GETNAME", "CLIENT SETINFO lib-name go-redis", "CLIENT SETINFO lib-ver 9", "CLIENT SETINFO nosuch x")
+	c.expect(t, "(nil)")
+	c.expect(t, "OK")
+	c.expect(t, "worker")
+	c.expect(t, "OK")
+	c.expect(t, "OK")
+	c.expect(t, "ERR Unrecognized option 'nosuch'")
+
+	c.send(t, "CLIENT INFO")
+	expectContains(t, c.read(t), "id="+id+" ", "name=worker", "resp=2", "tracking=false", "lib-name=go-redis", "lib-ver=9", "cmd=client")
+
+	other := dialResp(t)
+	other.send(t, "CLIENT SETNAME other")
+	other.expect(t, "OK")
+
+	c.send(t, "CLIENT LIST")
+	list := c.read(t)
+	expectContains(t, list, "id="+id+" ", "name=worker", "name=other")
+
+	c.send(t, "CLIENT", "CLIENT SETNAME", "CLIENT NOSUCH", "CLIENT CACHING yes")
+	c.expect(t, "ERR wrong number of arguments for 'client' command")
+	c.expect(t, "ERR wrong number of arguments for 'client|setname' command")
+	c.expect(t, "ERR unknown subcommand 'NOSUCH'")
+	c.expect(t, "OK")
+
+	//RESP3下CLIENT INFO同样为字符串
+	c.send(t, "HELLO 3", "CLIENT INFO")
+	c.read(t)
+	if kind, info := c.readType(t); kind != '$' || !strings.Contains(info, "resp=3") {
+		t.Fatalf("client info = %c %s", kind, info)
+	}
+}
+
+func TestRespCommand(t *testing.T) {
+	setup(t)
+	c := dialResp(t)
+
+	names := respCommandNames()
+
+	c.send(t, "COMMAND COUNT", "COMMAND LIST", "COMMAND INFO token nosuch", "COMMAND DOCS", "COMMAND NOSUCH")
+	c.expect(t, strconv.Itoa(len(names)))
+	list := c.read(t)
+	if list != "["+strings.Join(names, " ")+"]" {
+		t.Fatalf("command list = %s", list)
+	}
+	expectContains(t, list, "token", "hello", "client", "command", "info", "get")
+	c.expect(t, "[[token -1 [] 0 0 0] (nil)]")
+	c.expect(t, "[]")
+	c.expect(t, "ERR unknown subcommand 'NOSUCH'")
+
+	c.send(t, "COMMAND")
+	if all := c.read(t); strings.Count(all, " -1 [] 0 0 0]") != len(names) {
+		t.Fatalf("command = %s", all)
+	}
+}
+
+func TestRespInfo(t *testing.T) {
+	rc := setup(t)
+	do(t, rc, "token", "gzh")
+
+	for _, proto := range []string{"2", "3"} {
+		t.Run("resp"+proto, func(t *testing.T) {
+			c := dialResp(t)
+			c.send(t, "HELLO "+proto)
+			c.read(t)
+
+			c.send(t, "INFO")
+			kind, info := c.readType(t)
+			if kind != '$' {
+				t.Fatalf("info type = %c", kind)
+			}
+			expectContains(t, info, "# Server\r\n", "redis_mode:standalone\r\n", "# Clients\r\n", "# Stats\r\n", "# Weixin\r\n", "accounts:3\r\n", "cached_tokens:1\r\n", "open_breakers:0\r\n")
+
+			c.send(t, "INFO weixin")
+			weixin := c.read(t)
+			if strings.Contains(weixin, "# Server") || !strings.HasPrefix(weixin, "# Weixin\r\n") {
+				t.Fatalf("info weixin = %q", weixin)
+			}
+
+			c.send(t, "INFO everything")
+			expectContains(t, c.read(t), "# Server\r\n", "# Weixin\r\n")
+		})
+	}
+}
@@ -0,0 +1,140 @@
+package core
+
+import (
+	"github.com/tidwall/redcon"
+	"io"
+	"strings"
+	"sync"
+)
+
+// respServeMux 按命令名分发redis协议请求 监听成功后通过ready通知
+type respServeMux struct {
+	sync.Mutex
+	server   *redcon.Server
+	closed   bool
+	detached map[redcon.DetachedConn]struct{}
+	handlers map[string]redcon.HandlerFunc
+	onAccept func(conn redcon.Conn) bool
+	onClosed func(conn redcon.Conn, err error)
+}
+
+func newRespServeMux() *respServeMux {
+	return &respServeMux{
+		detached: make(map[redcon.DetachedConn]struct{}),
+		handlers: make(map[string]redcon.HandlerFunc),
+		onAccept: func(conn redcon.Conn) bool { return true },
+		onClosed: func(conn redcon.Conn, err error) {},
+	}
+}
+
+func (m *respServeMux) Handle(command string, handler redcon.HandlerFunc) {
+	if _, exist := m.handlers[command]; exist {
+		panic("resp: multiple registrations for " + command)
+	}
+	m.handlers[command] = handler
+}
+
+func (m *respServeMux) Accept(f func(conn redcon.Conn) bool) {
+	m.onAccept = f
+}
+
+func (m *respServeMux) Closed(f func(conn redcon.Conn, err error)) {
+	m.onClosed = f
+}
+
+func (m *respServeMux) serve(conn redcon.Conn, cmd redcon.Command) {
+	command := strings.ToLower(string(cmd.Args[0]))
+
+	if handler, ok := m.handlers[command]; ok {
+		handler(conn, cmd)
+	} else {
+		//与其他命令一样 回复写出前的通知暂存
+		client := clientOf(conn)
+		client.beginCommand()
+		conn.WriteError("ERR unknown command '" + command + "'")
+		client.endCommand()
+	}
+
+	if client, ok := conn.Context().(*respClient); ok {
+		if dconn := client.detach(conn); dconn != nil {
+			go m.serveDetached(client, dconn)
+		}
+	}
+}
+
+// serveDetached 脱离redcon的连接 逐条处理命令 每条回复写出后才写出期间暂存的通知
+func (m *respServeMux) serveDetached(client *respClient, dconn redcon.DetachedConn) {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		dconn.NetConn().Close()
+		return
+	}
+	m.detached[dconn] = struct{}{}
+	m.Unlock()
+
+	var err error
+	defer func() {
+		m.Lock()
+		delete(m.detached, dconn)
+		m.Unlock()
+
+		//redcon的Close会写出缓冲 与推送并发 直接关闭底层连接
+		dconn.NetConn().Close()
+		if err == io.EOF {
+			err = nil
+		}
+		m.onClosed(dconn, err)
+	}()
+
+	for {
+		//detach前最后一条命令的回复尚未写出
+		if err = client.flush(); err != nil {
+			return
+		}
+
+		var cmd redcon.Command
+		if cmd, err = dconn.ReadCommand(); err != nil {
+			return
+		}
+		m.serve(dconn, cmd)
+	}
+}
+
+// Run 监听address并处理请求 监听成功后调用ready 监听失败或服务结束时返回
+func (m *respServeMux) Run(address string, ready func()) error {
+	m.Lock()
+	if m.closed {
+		m.Unlock()
+		return nil
+	}
+	m.server = redcon.NewServerNetwork("tcp", address, m.serve, m.onAccept, m.onClosed)
+	m.Unlock()
+
+	signal := make(chan error, 1)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		if err := <-signal; err == nil {
+			ready()
+		}
+	}()
+
+	err := m.server.ListenServeAndSignal(signal)
+	<-done
+	return err
+}
+
+func (m *respServeMux) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	m.closed = true
+	for dconn := range m.detached {
+		dconn.NetConn().Close()
+	}
+	if m.server == nil {
+		return nil
+	}
+	return m.server.Close()
+}
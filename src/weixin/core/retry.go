@@ -0,0 +1,115 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"math/rand"
+	"time"
+	"weixin/common"
+)
+
+// RetryPolicy 请求微信接口失败后的重试策略 零值表示不重试
+type RetryPolicy struct {
+	// MaxAttempts 最多请求次数 包括第一次
+	MaxAttempts int
+	// Backoff 第一次重试前的等待时间 之后每次翻倍 实际等待时间在[d/2,d]之间随机
+	Backoff time.Duration
+	// MaxBackoff 单次等待时间上限
+	MaxBackoff time.Duration
+	// ErrCodes 可重试的微信错误码 请求本身失败时总是重试
+	ErrCodes []int
+	// Deadline 一次获取包括重试在内的总耗时上限 获取ticket时包括获取token 0表示不限制
+	Deadline time.Duration
+}
+
+func (p RetryPolicy) retryable(errCode int) bool {
+	for _, code := range p.ErrCodes {
+		if code == errCode {
+			return true
+		}
+	}
+	return false
+}
+
+// backoff 第attempt次重试前的等待时间 MaxBackoff为0时不限制
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	d := p.Backoff
+	if d <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt; i++ {
+		if d > math.MaxInt64/2 {
+			break
+		}
+		d *= 2
+	}
+	if p.MaxBackoff > 0 && d > p.MaxBackoff {
+		d = p.MaxBackoff
+	}
+
+	return d/2 + time.Duration(rand.Int63n(int64(d/2)+1))
+}
+
+// withDeadline 一次获取的总耗时上限 由获取token及ticket的各次请求共用
+func (m *Manager) withDeadline(ctx context.Context) (context.Context, context.CancelFunc) {
+	if m.retry.Deadline > 0 {
+		return context.WithTimeout(ctx, m.retry.Deadline)
+	}
+	return context.WithCancel(ctx)
+}
+
+// call 按重试策略请求微信接口 返回最后一次的响应或错误 熔断期间返回*breakerOpenError
+func (m *Manager) call(ctx context.Context, wi *WItem, kind, url string) (res []byte, err error) {
+	if ok, wait := m.breakers.allow(wi.Name, m.now()); !ok {
+		return nil, &breakerOpenError{wait: wait}
+	}
+
+	failed := true
+	defer func() {
+		m.breakers.done(wi.Name, failed, m.now())
+	}()
+
+	for attempt := 1; ; attempt++ {
+		res, err = m.upstream(ctx, wi, kind, url)
+
+		var errCode int
+		if err == nil {
+			//响应无法解析或返回错误码均计为熔断的失败 只有取得值才算成功
+			var wRes WResponse
+			if json.Unmarshal(res, &wRes) != nil {
+				return res, nil
+			}
+			if wRes.ErrorCode == 0 {
+				failed = false
+				return res, nil
+			}
+			if !m.retry.retryable(wRes.ErrorCode) {
+				return res, nil
+			}
+			errCode = wRes.ErrorCode
+		} else if ctx.Err() != nil {
+			return res, err
+		}
+
+		if attempt >= m.retry.MaxAttempts {
+			return res, err
+		}
+
+		delay := m.retry.backoff(attempt)
+		if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+			return res, err
+		}
+
+		common.Logger.Warn("retry weixin api", "section", wi.Name, "kind", kind, "attempt", attempt, "errcode", errCode, "err", err, "delay", delay)
+		observeUpstreamRetry(wi, kind)
+
+		timer := time.NewTimer(delay)
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return res, err
+		}
+	}
+}
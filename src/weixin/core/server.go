@@ -3,8 +3,9 @@ package core
 import (
 	"fmt"
 	"github.com/gin-gonic/gin"
-	"github.com/jonnywang/redcon2"
+	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tidwall/redcon"
+	"net"
 	"net/http"
 	"os"
 	"syscall"
@@ -21,7 +22,10 @@ func init() {
 }
 
 func RunInit() {
-	wx.LoadData()
+	//加载失败时保持未就绪
+	if err := manager().Load(); err == nil {
+		dataLoaded.Store(true)
+	}
 }
 
 func ExitServer() {
@@ -35,15 +39,38 @@ func RunRedisServer(ctx *common.ServerContext) {
 	defer ctx.Done()
 	ctx.Add()
 
-	rs := redcon2.NewRedconServeMux()
-	rs.Handle("version", func(conn redcon.Conn, cmd redcon.Command) {
+	rs := newRedisServeMux()
+
+	go func() {
+		common.Logger.Info("run redis protocol server", "address", common.Config.RedisAddress, "pid", PID)
+		err := rs.Run(common.Config.RedisAddress, func() {
+			respServing.Store(true)
+		})
+		respServing.Store(false)
+		if err != nil {
+			common.Logger.Error("redis protocol server fail", "err", err)
+			ExitServer()
+		}
+	}()
+
+	select {
+	case <-ctx.Quit():
+		common.Logger.Info("redis server catch exit signal")
+		rs.Close()
+	}
+}
+
+// newRedisServeMux 注册全部redis协议命令 存在mode=mock的section时才注册mockfail
+func newRedisServeMux() *respServeMux {
+	rs := newRespServeMux()
+	registerRespCommands(rs)
+	registerKeyspaceCommands(rs)
+	rs.Handle("version", handleCommand("version", func(conn redcon.Conn, cmd redcon.Command) {
 		conn.WriteBulkString(common.VERSION)
-	})
-	rs.Handle("command", func(conn redcon.Conn, cmd redcon.Command) {
-		conn.WriteString("OK")
-	})
-	rs.Handle("token", func(conn redcon.Conn, cmd redcon.Command) {
+	}))
+	rs.Handle("token", handleSectionCommand("token", func(conn redcon.Conn, cmd redcon.Command) {
 		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
 			conn.WriteError("ERR command args with token")
 			return
 		}
@@ -54,14 +81,16 @@ func RunRedisServer(ctx *common.ServerContext) {
 		}
 
 		wxValue, err := GetToken(string(cmd.Args[1]), cacheFirst)
+		respRecord(conn).track(kindToken, wxValue, cacheFirst, err)
 		if err != nil {
 			conn.WriteBulkString("")
 			return
 		}
 		conn.WriteBulkString(wxValue.value)
-	})
-	rs.Handle("ticket", func(conn redcon.Conn, cmd redcon.Command) {
+	}))
+	rs.Handle("ticket", handleSectionCommand("ticket", func(conn redcon.Conn, cmd redcon.Command) {
 		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
 			conn.WriteError("ERR command args with token")
 			return
 		}
@@ -72,14 +101,16 @@ func RunRedisServer(ctx *common.ServerContext) {
 		}
 
 		wxValue, err := GetTicket(string(cmd.Args[1]), cacheFirst)
+		respRecord(conn).track(kindTicket, wxValue, cacheFirst, err)
 		if err != nil {
 			conn.WriteBulkString("")
 			return
 		}
 		conn.WriteBulkString(wxValue.value)
-	})
-	rs.Handle("ztoken", func(conn redcon.Conn, cmd redcon.Command) {
+	}))
+	rs.Handle("ztoken", handleSectionCommand("ztoken", func(conn redcon.Conn, cmd redcon.Command) {
 		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
 			conn.WriteError("ERR command args with ztoken")
 			return
 		}
@@ -92,17 +123,19 @@ func RunRedisServer(ctx *common.ServerContext) {
 		conn.WriteArray(2)
 
 		wxValue, err := GetToken(string(cmd.Args[1]), cacheFirst)
+		respRecord(conn).track(kindToken, wxValue, cacheFirst, err)
 		if err == nil {
 			conn.WriteBulkString(wxValue.value)
 			conn.WriteBulkString(fmt.Sprintf("%d", wxValue.expireAt.Unix()))
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get token fail", "section", string(cmd.Args[1]), "err", err)
 			conn.WriteBulkString("")
 			conn.WriteBulkString("0")
 		}
-	})
-	rs.Handle("zticket", func(conn redcon.Conn, cmd redcon.Command) {
+	}))
+	rs.Handle("zticket", handleSectionCommand("zticket", func(conn redcon.Conn, cmd redcon.Command) {
 		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
 			conn.WriteError("ERR command args with zticket")
 			return
 		}
@@ -115,18 +148,20 @@ func RunRedisServer(ctx *common.ServerContext) {
 		conn.WriteArray(2)
 
 		wxValue, err := GetTicket(string(cmd.Args[1]), cacheFirst)
+		respRecord(conn).track(kindTicket, wxValue, cacheFirst, err)
 		if err == nil {
 			conn.WriteBulkString(wxValue.value)
 			conn.WriteBulkString(fmt.Sprintf("%d", wxValue.expireAt.Unix()))
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get ticket fail", "section", string(cmd.Args[1]), "err", err)
 			conn.WriteBulkString("")
 			conn.WriteBulkString("0")
 		}
-	})
+	}))
 	//增加过期时间戳一起返回
-	rs.Handle("zall", func(conn redcon.Conn, cmd redcon.Command) {
+	rs.Handle("zall", handleSectionCommand("zall", func(conn redcon.Conn, cmd redcon.Command) {
 		if len(cmd.Args) < 2 {
+			respRecord(conn).fail("invalid args")
 			conn.WriteError("ERR command args with zall")
 			return
 		}
@@ -134,47 +169,39 @@ func RunRedisServer(ctx *common.ServerContext) {
 		conn.WriteArray(4)
 
 		wxValue, err := GetToken(string(cmd.Args[1]), false)
+		respRecord(conn).track(kindToken, wxValue, false, err)
 		if err == nil {
 			conn.WriteBulkString(wxValue.value)
 			conn.WriteBulkString(fmt.Sprintf("%d", wxValue.expireAt.Unix()))
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get token fail", "section", string(cmd.Args[1]), "err", err)
 			conn.WriteBulkString("")
 			conn.WriteBulkString("0")
 		}
 
 		wxValue, err = GetTicket(string(cmd.Args[1]), false)
+		respRecord(conn).track(kindTicket, wxValue, false, err)
 		if err == nil {
 			conn.WriteBulkString(wxValue.value)
 			conn.WriteBulkString(fmt.Sprintf("%d", wxValue.expireAt.Unix()))
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get ticket fail", "section", string(cmd.Args[1]), "err", err)
 			conn.WriteBulkString("")
 			conn.WriteBulkString("0")
 		}
-	})
-	rs.Handle("save", func(conn redcon.Conn, cmd redcon.Command) {
+	}))
+	rs.Handle("mztoken", handleCommand("mztoken", handleMulti(kindToken)))
+	rs.Handle("mzticket", handleCommand("mzticket", handleMulti(kindTicket)))
+	rs.Handle("accounts", handleCommand("accounts", handleAccounts))
+	rs.Handle("save", handleCommand("save", func(conn redcon.Conn, cmd redcon.Command) {
 		go SaveAll()
 		conn.WriteString("OK")
-	})
-
-	go func() {
-		common.Logger.Printf("run redis protocol server at %+v with pid=%d", common.Config.RedisAddress, PID)
-		err := rs.Run(common.Config.RedisAddress)
-		if err != nil {
-			common.Logger.Print(err)
-			rs = nil
-			ExitServer()
-		}
-	}()
-
-	select {
-	case <-ctx.Quit():
-		common.Logger.Print("redis server catch exit signal")
-		if rs != nil {
-			rs.Close()
-		}
+	}))
+	if manager().mockEnabled() {
+		rs.Handle("mockfail", handleSectionCommand("mockfail", handleMockFail))
 	}
+
+	return rs
 }
 
 func RunWebServer(ctx *common.ServerContext) {
@@ -182,7 +209,15 @@ func RunWebServer(ctx *common.ServerContext) {
 	ctx.Add()
 
 	gin.SetMode(gin.ReleaseMode)
-	router := gin.Default()
+	gin.DefaultErrorWriter = common.NewLogWriter("gin")
+	router := gin.New()
+	router.Use(gin.Recovery(), handleRoute())
+	if len(common.Config.AdminAddress) == 0 {
+		router.GET("/metrics", gin.WrapH(metricsHandler()))
+		router.GET("/healthz", healthz)
+		router.GET("/readyz", readyz)
+		router.GET("/accounts", accounts)
+	}
 	router.GET("/", func(c *gin.Context) {
 		c.String(http.StatusOK, "version "+common.VERSION)
 	})
@@ -191,10 +226,11 @@ func RunWebServer(ctx *common.ServerContext) {
 		flag := c.Param("flag")
 
 		wxValue, err := GetToken(name, flag != "/1")
+		httpRecord(c).track(kindToken, wxValue, flag != "/1", err)
 		if err == nil {
 			c.String(http.StatusOK, wxValue.value)
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get token fail", "section", name, "err", err)
 			c.String(http.StatusOK, "")
 		}
 	})
@@ -203,10 +239,11 @@ func RunWebServer(ctx *common.ServerContext) {
 		flag := c.Param("flag")
 
 		wxValue, err := GetTicket(name, flag != "/1")
+		httpRecord(c).track(kindTicket, wxValue, flag != "/1", err)
 		if err == nil {
 			c.String(http.StatusOK, wxValue.value)
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get ticket fail", "section", name, "err", err)
 			c.String(http.StatusOK, "")
 		}
 	})
@@ -215,10 +252,11 @@ func RunWebServer(ctx *common.ServerContext) {
 		flag := c.Param("flag")
 
 		wxValue, err := GetToken(name, flag != "/1")
+		httpRecord(c).track(kindToken, wxValue, flag != "/1", err)
 		if err == nil {
 			c.JSON(http.StatusOK, gin.H{"value": wxValue.value, "expireAt": wxValue.expireAt.Unix()})
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get token fail", "section", name, "err", err)
 			c.JSON(http.StatusOK, gin.H{"value": "", "expireAt": 0})
 		}
 	})
@@ -227,10 +265,11 @@ func RunWebServer(ctx *common.ServerContext) {
 		flag := c.Param("flag")
 
 		wxValue, err := GetTicket(name, flag != "/1")
+		httpRecord(c).track(kindTicket, wxValue, flag != "/1", err)
 		if err == nil {
 			c.JSON(http.StatusOK, gin.H{"value": wxValue.value, "expireAt": wxValue.expireAt.Unix()})
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get ticket fail", "section", name, "err", err)
 			c.JSON(http.StatusOK, gin.H{"value": "", "expireAt": 0})
 		}
 	})
@@ -243,58 +282,276 @@ func RunWebServer(ctx *common.ServerContext) {
 		}
 
 		wxValue, err := GetToken(name, false)
+		httpRecord(c).track(kindToken, wxValue, false, err)
 		if err == nil {
 			result["token"] = gin.H{"value": wxValue.value, "expireAt": wxValue.expireAt.Unix()}
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get token fail", "section", name, "err", err)
 		}
 
 		wxValue, err = GetTicket(name, false)
+		httpRecord(c).track(kindTicket, wxValue, false, err)
 		if err == nil {
 			result["ticket"] = gin.H{"value": wxValue.value, "expireAt": wxValue.expireAt.Unix()}
 		} else {
-			common.Logger.Print(err)
+			common.Logger.Warn("get ticket fail", "section", name, "err", err)
 		}
 
 		c.JSON(http.StatusOK, result)
 	})
+	router.POST("/batch", batch)
+	registerV2(router)
 	server := &http.Server{
 		Addr:    common.Config.WebAddress,
 		Handler: router,
 	}
 
 	go func() {
+		ln, err := net.Listen("tcp", server.Addr)
+		if err != nil {
+			common.Logger.Error("web server fail", "err", err)
+			ExitServer()
+			return
+		}
+
+		webServing.Store(true)
+		err = server.Serve(ln)
+		webServing.Store(false)
+		if err != nil && err != http.ErrServerClosed {
+			common.Logger.Error("web server fail", "err", err)
+			ExitServer()
+		}
+	}()
+
+	select {
+	case <-ctx.Quit():
+		common.Logger.Info("web server catch exit signal")
+		server.Shutdown(ctx.Context())
+	}
+}
+
+// RunAdminServer 配置admin时单独监听 提供/metrics,/healthz,/readyz等管理接口
+func RunAdminServer(ctx *common.ServerContext) {
+	defer ctx.Done()
+	ctx.Add()
+
+	router := gin.New()
+	router.Use(gin.Recovery())
+	router.GET("/metrics", gin.WrapH(metricsHandler()))
+	router.GET("/healthz", healthz)
+	router.GET("/readyz", readyz)
+	router.GET("/accounts", accounts)
+
+	server := &http.Server{
+		Addr:    common.Config.AdminAddress,
+		Handler: router,
+	}
+
+	go func() {
+		common.Logger.Info("run admin server", "address", common.Config.AdminAddress)
 		if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			common.Logger.Print(err)
+			common.Logger.Error("admin server fail", "err", err)
 			ExitServer()
 		}
 	}()
 
 	select {
 	case <-ctx.Quit():
-		common.Logger.Print("redis server catch exit signal")
+		common.Logger.Info("admin server catch exit signal")
 		server.Shutdown(ctx.Context())
 	}
 }
 
+// configAccounts 配置了app_secret或mode=mock的section is_enterprise错误时记录在ConfigError
+func configAccounts() ([]Account, error) {
+	names := common.Config.Accounts()
+	accounts := make([]Account, 0, len(names))
+
+	for _, name := range names {
+		account := Account{
+			Name:      name,
+			AppId:     common.Config.AppId(name),
+			AppSecret: common.Config.AppSecret(name),
+		}
+
+		//is_enterprise未配置或配置错误时只有该section的请求失败
+		isEnterprise, err := common.Config.IniCfg.Section(name).Key("is_enterprise").Bool()
+		if err != nil {
+			account.ConfigError = fmt.Sprintf("invalid is_enterprise of %s %v", name, err)
+			common.Logger.Error("section config error", "section", name, "err", account.ConfigError)
+		}
+		account.IsEnterprise = isEnterprise
+
+		account.Egress = configEgress(name)
+		if err := account.Egress.Validate(); err != nil {
+			return nil, fmt.Errorf("invalid egress of %s %v", name, err)
+		}
+		if !account.Egress.isZero() {
+			common.Logger.Info("section egress", "section", name, "egress", account.Egress.String())
+		}
+
+		switch mode := common.Config.SectionMode(name); mode {
+		case "":
+		case common.ModeMock:
+			mock, err := configMock(name)
+			if err != nil {
+				return nil, err
+			}
+			account.Mock = mock
+			common.Logger.Warn("section in mock mode, weixin api will not be requested", "section", name)
+		default:
+			return nil, fmt.Errorf("invalid mode of %s %s", name, mode)
+		}
+
+		accounts = append(accounts, account)
+	}
+
+	return accounts, nil
+}
+
+// configEgress section配置了http_proxy或socks5_proxy时同时替换全局的两项 配置为空时直连
+func configEgress(name string) Egress {
+	egress := Egress{
+		HttpProxy:   common.Config.HttpProxy,
+		Socks5Proxy: common.Config.Socks5Proxy,
+		BindAddress: common.Config.SectionValue(name, "bind_address", common.Config.BindAddress),
+	}
+
+	section := common.Config.IniCfg.Section(name)
+	if section.HasKey("http_proxy") || section.HasKey("socks5_proxy") {
+		egress.HttpProxy = common.Config.SectionValue(name, "http_proxy", "")
+		egress.Socks5Proxy = common.Config.SectionValue(name, "socks5_proxy", "")
+	}
+
+	return egress
+}
+
+// configMock section的mock_expires_in,mock_errcode,mock_errmsg 未配置时使用全局配置
+func configMock(name string) (*MockOptions, error) {
+	mock := &MockOptions{
+		ExpiresIn: common.Config.MockExpiresIn,
+		ErrCode:   common.Config.MockErrCode,
+		ErrMsg:    common.Config.MockErrMsg,
+	}
+
+	section := common.Config.IniCfg.Section(name)
+	if key, err := section.GetKey("mock_expires_in"); err == nil {
+		if mock.ExpiresIn, err = key.Int(); err != nil {
+			return nil, fmt.Errorf("invalid mock_expires_in of %s %v", name, err)
+		}
+	}
+	if key, err := section.GetKey("mock_errcode"); err == nil {
+		if mock.ErrCode, err = key.Int(); err != nil {
+			return nil, fmt.Errorf("invalid mock_errcode of %s %v", name, err)
+		}
+	}
+	if key, err := section.GetKey("mock_errmsg"); err == nil {
+		mock.ErrMsg = key.String()
+	}
+
+	return mock, nil
+}
+
 func Run() error {
+	storage, err := NewStorage(StorageConfig{
+		Type:          common.Config.Storage,
+		DataFile:      common.Config.DataFile,
+		DataBackups:   common.Config.DataBackups,
+		Path:          common.Config.StoragePath,
+		Redis:         common.Config.StorageRedis,
+		RedisPassword: common.Config.StorageRedisPassword,
+		RedisDB:       common.Config.StorageRedisDB,
+		Prefix:        common.Config.StoragePrefix,
+		DataKey:       common.Config.DataKey,
+	})
+	if err != nil {
+		return err
+	}
+	if storage != nil {
+		common.Logger.Info("use storage", "storage", storage.Name())
+		defer storage.Close()
+	}
+
+	var cluster *Cluster
+	if common.Config.Cluster {
+		owner := common.Config.InstanceId
+		if len(owner) == 0 {
+			hostname, _ := os.Hostname()
+			owner = fmt.Sprintf("%s-%d", hostname, PID)
+		}
+
+		cluster, err = NewCluster(storage, owner, time.Duration(common.Config.ClusterLease)*time.Second)
+		if err != nil {
+			return err
+		}
+	}
+
+	accounts, err := configAccounts()
+	if err != nil {
+		return err
+	}
+
+	SetDefaultSetting(HttpSettings{
+		UserAgent:           "Server",
+		ConnectTimeout:      time.Duration(common.Config.UpstreamConnTimeout) * time.Second,
+		ReadWriteTimeout:    time.Duration(common.Config.UpstreamTimeout) * time.Second,
+		MaxIdleConnsPerHost: common.Config.UpstreamMaxIdle,
+		IdleConnTimeout:     time.Duration(common.Config.UpstreamIdleTimeout) * time.Second,
+		DisableHTTP2:        !common.Config.UpstreamHttp2,
+	})
+
+	m, err := NewManager(ManagerConfig{
+		Accounts: accounts,
+		Storage:  storage,
+		Cluster:  cluster,
+		Retry: RetryPolicy{
+			MaxAttempts: common.Config.RetryAttempts,
+			Backoff:     time.Duration(common.Config.RetryBackoff) * time.Millisecond,
+			MaxBackoff:  time.Duration(common.Config.RetryMaxBackoff) * time.Millisecond,
+			ErrCodes:    common.Config.RetryErrCodes,
+			Deadline:    time.Duration(common.Config.UpstreamDeadline) * time.Second,
+		},
+		Breaker: BreakerPolicy{
+			Threshold: common.Config.BreakerThreshold,
+			Cooldown:  time.Duration(common.Config.BreakerCooldown) * time.Second,
+		},
+		OnChange:   valueChanged,
+		Registerer: prometheus.DefaultRegisterer,
+	})
+	if err != nil {
+		return err
+	}
+	wx.Store(m)
+
 	ctx := common.NewServerContext()
 
 	ctx.Set("startTime", runAtTime)
 
+	if cluster != nil {
+		go cluster.Run(ctx)
+	}
+
 	go RunInit()
 	go RunRedisServer(ctx)
 	go RunWebServer(ctx)
+	if len(common.Config.GrpcAddress) > 0 {
+		go RunGrpcServer(ctx)
+	}
+	if len(common.Config.AdminAddress) > 0 {
+		go RunAdminServer(ctx)
+	}
 
 	select {
 	case <-ctx.Interrupt():
-		common.Logger.Print("server interrupt")
+		common.Logger.Info("server interrupt")
+		//先取消进行中的微信接口请求 避免阻塞各服务退出
+		m.Close()
 		ctx.Cancel()
 	}
 
 	ctx.Wait()
-	common.Logger.Printf("server uptime %v %v", runAtTime.Format("2006-01-02 15:04:05"), time.Now().Sub(runAtTime))
-	common.Logger.Print("server exit")
+	common.Logger.Info("server uptime", "startAt", runAtTime.Format("2006-01-02 15:04:05"), "uptime", time.Now().Sub(runAtTime).String())
+	common.Logger.Info("server exit")
 
 	return nil
 }
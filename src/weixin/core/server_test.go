@@ -0,0 +1,1128 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/gin-gonic/gin"
+	"github.com/redis/go-redis/v9"
+	"github.com/tidwall/redcon"
+	"io"
+	"math"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"weixin/common"
+	"weixin/wxtest"
+)
+
+const (
+	testAppId  = "wx_gzh"
+	testCorpId = "ww_qy"
+)
+
+var (
+	fake     *wxtest.Server
+	respAddr string
+	webAddr  string
+)
+
+// TestMain 启动模拟微信接口及RESP,web服务 各测试通过setup替换wx
+func TestMain(m *testing.M) {
+	gin.SetMode(gin.TestMode)
+	common.SetupLogger("text", "error", io.Discard)
+	common.SetupAccessLogger("text", io.Discard)
+
+	fake = wxtest.NewServer()
+
+	respAddr = freeAddr()
+	webAddr = freeAddr()
+	common.Config.RedisAddress = respAddr
+	common.Config.WebAddress = webAddr
+
+	empty, _ := NewManager(ManagerConfig{})
+	wx.Store(empty)
+
+	ctx := common.NewServerContext()
+	go RunRedisServer(ctx)
+	go RunWebServer(ctx)
+	//等待就绪标记而不只是端口 确保各服务启动时已读完全局配置
+	for !respServing.Load() || !webServing.Load() {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	code := m.Run()
+
+	ctx.Cancel()
+	ctx.Wait()
+	fake.Close()
+
+	os.Exit(code)
+}
+
+func freeAddr() string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		panic(err)
+	}
+	defer l.Close()
+
+	return l.Addr().String()
+}
+
+func waitListen(addr string) {
+	for i := 0; i < 100; i++ {
+		if conn, err := net.Dial("tcp", addr); err == nil {
+			conn.Close()
+			return
+		}
+		time.Sleep(20 * time.Millisecond)
+	}
+	panic("server not listening on " + addr)
+}
+
+// setup 重置模拟接口 gzh为公众号 qy为企业微信 noid未配置app_id
+func setup(t *testing.T) *redis.Client {
+	t.Helper()
+
+	fake.Reset()
+	fake.AddAccount(testAppId, "gzh_secret")
+	fake.AddAccount(testCorpId, "qy_secret")
+
+	client := fake.Client()
+	client.Timeout = 300 * time.Millisecond
+
+	m, err := NewManager(ManagerConfig{
+		Accounts: []Account{
+			{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"},
+			{Name: "qy", AppId: testCorpId, AppSecret: "qy_secret", IsEnterprise: true},
+			{Name: "noid", AppSecret: "secret"},
+		},
+		HTTPClient: client,
+		OnChange:   valueChanged,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wx.Store(m)
+
+	rc := redis.NewClient(&redis.Options{Addr: respAddr, Protocol: 2})
+	t.Cleanup(func() { rc.Close() })
+
+	return rc
+}
+
+func do(t *testing.T, rc *redis.Client, args ...interface{}) interface{} {
+	t.Helper()
+
+	v, err := rc.Do(context.Background(), args...).Result()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+
+	return v
+}
+
+func doStrings(t *testing.T, rc *redis.Client, args ...interface{}) []string {
+	t.Helper()
+
+	v, err := rc.Do(context.Background(), args...).StringSlice()
+	if err != nil {
+		t.Fatalf("%v: %v", args, err)
+	}
+
+	return v
+}
+
+func httpDo(t *testing.T, method, path, body string) (int, string) {
+	t.Helper()
+
+	req, err := http.NewRequest(method, "http://"+webAddr+path, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	res, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer res.Body.Close()
+
+	data, _ := io.ReadAll(res.Body)
+
+	return res.StatusCode, string(data)
+}
+
+func expectRequests(t *testing.T, endpoint string, n int) {
+	t.Helper()
+
+	if got := fake.Requests(endpoint); got != n {
+		t.Fatalf("%s requests = %d, want %d", endpoint, got, n)
+	}
+}
+
+func TestRespTokenCached(t *testing.T) {
+	rc := setup(t)
+
+	token := do(t, rc, "token", "gzh")
+	if token != fake.CurrentToken(testAppId) {
+		t.Fatalf("token = %v, want %v", token, fake.CurrentToken(testAppId))
+	}
+	if again := do(t, rc, "token", "gzh"); again != token {
+		t.Fatalf("cached token = %v, want %v", again, token)
+	}
+	expectRequests(t, wxtest.Token, 1)
+
+	forced := do(t, rc, "token", "gzh", "1")
+	if forced == token || forced != fake.CurrentToken(testAppId) {
+		t.Fatalf("forced token = %v, old %v", forced, token)
+	}
+	expectRequests(t, wxtest.Token, 2)
+}
+
+func TestRespZTokenExpireAt(t *testing.T) {
+	rc := setup(t)
+
+	res := doStrings(t, rc, "ztoken", "gzh")
+	if len(res) != 2 || res[0] != fake.CurrentToken(testAppId) {
+		t.Fatalf("ztoken = %v", res)
+	}
+
+	expireAt, _ := strconv.ParseInt(res[1], 10, 64)
+	want := time.Now().Add(7190 * time.Second).Unix()
+	if expireAt < want-2 || expireAt > want+2 {
+		t.Fatalf("expireAt = %d, want about %d", expireAt, want)
+	}
+}
+
+func TestRespTicket(t *testing.T) {
+	rc := setup(t)
+
+	ticket := do(t, rc, "ticket", "gzh").(string)
+	if !strings.HasPrefix(ticket, "TICKET_"+testAppId+"_JSAPI_") {
+		t.Fatalf("ticket = %v", ticket)
+	}
+
+	res := doStrings(t, rc, "zticket", "gzh")
+	if res[0] != ticket {
+		t.Fatalf("zticket = %v, want %v", res, ticket)
+	}
+	expectRequests(t, wxtest.Token, 1)
+	expectRequests(t, wxtest.Ticket, 1)
+
+	//zall强制刷新token 强制刷新ticket时会再次刷新token
+	all := doStrings(t, rc, "zall", "gzh")
+	if len(all) != 4 || !strings.HasPrefix(all[0], "TOKEN_") || all[2] == ticket || all[2] == "" {
+		t.Fatalf("zall = %v", all)
+	}
+	expectRequests(t, wxtest.Token, 3)
+	expectRequests(t, wxtest.Ticket, 2)
+}
+
+func TestRespUnknownSection(t *testing.T) {
+	rc := setup(t)
+
+	for _, name := range []string{"nope", "noid"} {
+		if v := do(t, rc, "token", name); v != "" {
+			t.Fatalf("token %s = %v", name, v)
+		}
+		if v := doStrings(t, rc, "ztoken", name); v[0] != "" || v[1] != "0" {
+			t.Fatalf("ztoken %s = %v", name, v)
+		}
+	}
+
+	if err := rc.Do(context.Background(), "token").Err(); err == nil {
+		t.Fatal("token without section should fail")
+	}
+	expectRequests(t, wxtest.Token, 0)
+}
+
+func TestRespEnterprise(t *testing.T) {
+	rc := setup(t)
+
+	if v := do(t, rc, "token", "qy"); v != fake.CurrentToken(testCorpId) {
+		t.Fatalf("token = %v", v)
+	}
+	if v := do(t, rc, "ticket", "qy").(string); !strings.HasPrefix(v, "TICKET_"+testCorpId+"_JSAPI_") {
+		t.Fatalf("ticket = %v", v)
+	}
+	expectRequests(t, wxtest.QyToken, 1)
+	expectRequests(t, wxtest.QyTicket, 1)
+	expectRequests(t, wxtest.Token, 0)
+
+	code, body := httpDo(t, http.MethodGet, "/v2/ticket/qy?type=wx_card", "")
+	if code != http.StatusBadRequest || !strings.Contains(body, errInvalidType) {
+		t.Fatalf("wx_card of enterprise = %d %s", code, body)
+	}
+}
+
+func TestRespKeyspace(t *testing.T) {
+	rc := setup(t)
+
+	token, err := rc.Get(context.Background(), "token:gzh").Result()
+	if err != nil || token != fake.CurrentToken(testAppId) {
+		t.Fatalf("get token:gzh = %v %v", token, err)
+	}
+
+	card, err := rc.Get(context.Background(), "ticket:gzh:wx_card").Result()
+	if err != nil || !strings.HasPrefix(card, "TICKET_"+testAppId+"_WX_CARD_") {
+		t.Fatalf("get ticket:gzh:wx_card = %v %v", card, err)
+	}
+
+	if _, err := rc.Get(context.Background(), "token:nope").Result(); err != redis.Nil {
+		t.Fatalf("get token:nope = %v", err)
+	}
+
+	//获取失败时与其他命令一样返回ERR开头的错误
+	fake.Push(wxtest.QyToken, wxtest.Fail(wxtest.ErrIPWhitelist))
+	if _, err := rc.Get(context.Background(), "token:qy").Result(); err == nil || !strings.HasPrefix(err.Error(), "ERR ") {
+		t.Fatalf("get token:qy = %v", err)
+	}
+	if _, err := rc.Get(context.Background(), "token:noid").Result(); err == nil || err.Error() != "ERR not found match gzh config with noid" {
+		t.Fatalf("get token:noid = %v", err)
+	}
+}
+
+// TestTicketInvalidToken 缓存的token已失效时ticket接口返回40001 强制刷新token后重试
+func TestTicketInvalidToken(t *testing.T) {
+	rc := setup(t)
+
+	token := do(t, rc, "token", "gzh")
+	fake.Revoke(testAppId)
+
+	ticket := do(t, rc, "ticket", "gzh").(string)
+	if len(ticket) == 0 {
+		t.Fatal("ticket should be fetched with refreshed token")
+	}
+	if v := do(t, rc, "token", "gzh"); v == token || v != fake.CurrentToken(testAppId) {
+		t.Fatalf("token = %v, want refreshed", v)
+	}
+	expectRequests(t, wxtest.Token, 2)
+	expectRequests(t, wxtest.Ticket, 2)
+}
+
+func TestUpstreamErrors(t *testing.T) {
+	for _, e := range []wxtest.Error{wxtest.ErrApiLimit, wxtest.ErrIPWhitelist, wxtest.ErrSystemBusy, wxtest.ErrSecret} {
+		t.Run(strconv.Itoa(e.ErrCode), func(t *testing.T) {
+			rc := setup(t)
+
+			fake.Push(wxtest.Token, wxtest.Fail(e))
+			if v := doStrings(t, rc, "ztoken", "gzh"); v[0] != "" || v[1] != "0" {
+				t.Fatalf("ztoken = %v", v)
+			}
+
+			fake.Push(wxtest.Token, wxtest.Fail(e))
+			code, body := httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+
+			var res struct {
+				Error v2Error `json:"error"`
+			}
+			json.Unmarshal([]byte(body), &res)
+			if code != http.StatusBadGateway || res.Error.Code != errUpstreamReject || res.Error.ErrCode != e.ErrCode || res.Error.ErrMsg != e.ErrMsg {
+				t.Fatalf("v2 token = %d %s", code, body)
+			}
+
+			_, body = httpDo(t, http.MethodGet, "/accounts", "")
+			if !strings.Contains(body, fmt.Sprintf("errcode=%d", e.ErrCode)) {
+				t.Fatalf("accounts should contain last error: %s", body)
+			}
+
+			//脚本用完后恢复正常
+			if v := do(t, rc, "token", "gzh"); v != fake.CurrentToken(testAppId) {
+				t.Fatalf("token after recovery = %v", v)
+			}
+		})
+	}
+}
+
+func TestUpstreamTimeout(t *testing.T) {
+	rc := setup(t)
+
+	fake.Push(wxtest.Token, wxtest.Timeout(2*time.Second))
+
+	startAt := time.Now()
+	code, body := httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+	if code != http.StatusBadGateway || !strings.Contains(body, errUpstreamFail) {
+		t.Fatalf("v2 token = %d %s", code, body)
+	}
+	if elapsed := time.Since(startAt); elapsed > time.Second {
+		t.Fatalf("timeout took %v", elapsed)
+	}
+
+	if v := do(t, rc, "token", "gzh"); v != fake.CurrentToken(testAppId) {
+		t.Fatalf("token after timeout = %v", v)
+	}
+}
+
+func TestUpstreamMalformedResponse(t *testing.T) {
+	setup(t)
+
+	fake.Push(wxtest.Token, wxtest.Behavior{Body: "<html>bad gateway</html>"})
+	code, body := httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+	if code != http.StatusBadGateway || !strings.Contains(body, errUpstreamReject) {
+		t.Fatalf("v2 token = %d %s", code, body)
+	}
+}
+
+// TestShortExpiresIn 实际有效期为expires_in-10秒 过期后重新请求
+func TestShortExpiresIn(t *testing.T) {
+	rc := setup(t)
+
+	fake.Push(wxtest.Token, wxtest.Expires(11))
+	first := do(t, rc, "token", "gzh")
+
+	time.Sleep(1100 * time.Millisecond)
+
+	second := do(t, rc, "token", "gzh")
+	if second == first {
+		t.Fatal("expired token should be refreshed")
+	}
+	expectRequests(t, wxtest.Token, 2)
+}
+
+func TestTokenFailureDropsTickets(t *testing.T) {
+	rc := setup(t)
+
+	do(t, rc, "ticket", "gzh")
+
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrIPWhitelist))
+	do(t, rc, "token", "gzh", "1")
+
+	if n := do(t, rc, "exists", "ticket:gzh"); n != int64(0) {
+		t.Fatalf("ticket should be dropped, exists = %v", n)
+	}
+}
+
+func TestHttpRoutes(t *testing.T) {
+	setup(t)
+
+	code, body := httpDo(t, http.MethodGet, "/token/gzh/", "")
+	if code != http.StatusOK || body != fake.CurrentToken(testAppId) {
+		t.Fatalf("/token = %d %s", code, body)
+	}
+
+	code, body = httpDo(t, http.MethodGet, "/token/gzh/1", "")
+	if body != fake.CurrentToken(testAppId) {
+		t.Fatalf("/token forced = %d %s", code, body)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	var value struct {
+		Value    string `json:"value"`
+		ExpireAt int64  `json:"expireAt"`
+	}
+	_, body = httpDo(t, http.MethodGet, "/zticket/gzh/", "")
+	json.Unmarshal([]byte(body), &value)
+	if !strings.HasPrefix(value.Value, "TICKET_") || value.ExpireAt == 0 {
+		t.Fatalf("/zticket = %s", body)
+	}
+
+	_, body = httpDo(t, http.MethodGet, "/ticket/gzh/", "")
+	if body != value.Value {
+		t.Fatalf("/ticket = %s, want %s", body, value.Value)
+	}
+
+	_, body = httpDo(t, http.MethodGet, "/ztoken/nope/", "")
+	if body != `{"expireAt":0,"value":""}` {
+		t.Fatalf("/ztoken unknown = %s", body)
+	}
+
+	var all map[string]struct {
+		Value string `json:"value"`
+	}
+	_, body = httpDo(t, http.MethodGet, "/zall/gzh", "")
+	json.Unmarshal([]byte(body), &all)
+	if !strings.HasPrefix(all["token"].Value, "TOKEN_") || len(all["ticket"].Value) == 0 {
+		t.Fatalf("/zall = %s", body)
+	}
+}
+
+func TestHttpV2(t *testing.T) {
+	setup(t)
+
+	var res struct {
+		Data v2Value `json:"data"`
+	}
+
+	code, body := httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Data.Value != fake.CurrentToken(testAppId) || res.Data.Source != sourceUpstream {
+		t.Fatalf("GET = %d %s", code, body)
+	}
+
+	httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+	code, body = httpDo(t, http.MethodPost, "/v2/token/gzh", "")
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Data.Value != fake.CurrentToken(testAppId) {
+		t.Fatalf("POST = %d %s", code, body)
+	}
+	expectRequests(t, wxtest.Token, 2)
+
+	code, body = httpDo(t, http.MethodGet, "/v2/ticket/gzh?type=wx_card", "")
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || res.Data.Type != ticketWxCard || !strings.Contains(res.Data.Value, "_WX_CARD_") {
+		t.Fatalf("wx_card = %d %s", code, body)
+	}
+
+	code, body = httpDo(t, http.MethodGet, "/v2/token/nope", "")
+	if code != http.StatusNotFound || !strings.Contains(body, errNotFound) {
+		t.Fatalf("unknown = %d %s", code, body)
+	}
+}
+
+func TestHttpBatch(t *testing.T) {
+	setup(t)
+
+	code, body := httpDo(t, http.MethodPost, "/batch", `{"sections":["gzh","qy","nope"],"kinds":["token","ticket"]}`)
+
+	var res struct {
+		Items []batchResult `json:"items"`
+	}
+	json.Unmarshal([]byte(body), &res)
+	if code != http.StatusOK || len(res.Items) != 6 {
+		t.Fatalf("batch = %d %s", code, body)
+	}
+
+	for _, item := range res.Items {
+		if item.Section == "nope" {
+			if len(item.Error) == 0 {
+				t.Fatalf("batch item %+v should fail", item)
+			}
+			continue
+		}
+		if len(item.Value) == 0 || item.ExpireAt == 0 {
+			t.Fatalf("batch item %+v", item)
+		}
+	}
+	expectRequests(t, wxtest.Token, 1)
+	expectRequests(t, wxtest.QyToken, 1)
+}
+
+// MZTOKEN 按参数顺序返回[value,expireAt] 未配置的section返回空值及0 不影响其他section
+func TestRespMulti(t *testing.T) {
+	rc := setup(t)
+
+	res, err := rc.Do(context.Background(), "mztoken", "gzh", "nope", "qy", "noid", "gzh").Slice()
+	if err != nil || len(res) != 5 {
+		t.Fatalf("mztoken = %v %v", res, err)
+	}
+	want := []string{fake.CurrentToken(testAppId), "", fake.CurrentToken(testCorpId), "", fake.CurrentToken(testAppId)}
+	for i, item := range res {
+		pair, ok := item.([]interface{})
+		if !ok || len(pair) != 2 || pair[0] != want[i] {
+			t.Fatalf("mztoken[%d] = %v, want %s", i, item, want[i])
+		}
+		if expireAt, _ := strconv.ParseInt(pair[1].(string), 10, 64); (len(want[i]) > 0) != (expireAt > time.Now().Unix()) {
+			t.Fatalf("mztoken[%d] expireAt = %v", i, pair[1])
+		}
+	}
+	expectRequests(t, wxtest.Token, 1)
+	expectRequests(t, wxtest.QyToken, 1)
+
+	tickets, err := rc.Do(context.Background(), "mzticket", "nope", "gzh").Slice()
+	if err != nil || len(tickets) != 2 || tickets[0].([]interface{})[0] != "" || tickets[1].([]interface{})[0] == "" {
+		t.Fatalf("mzticket = %v %v", tickets, err)
+	}
+
+	if err := rc.Do(context.Background(), "mztoken").Err(); err == nil || err.Error() != "ERR command args with mtoken" {
+		t.Fatalf("mztoken without sections = %v", err)
+	}
+}
+
+// ACCOUNTS及/accounts列出所有section app_secret只输出指纹
+func TestAccounts(t *testing.T) {
+	rc := setup(t)
+	do(t, rc, "token", "gzh")
+
+	res, err := rc.Do(context.Background(), "accounts").Slice()
+	if err != nil || len(res) != 3 {
+		t.Fatalf("accounts = %v %v", res, err)
+	}
+	accounts := make(map[string]map[string]interface{})
+	for _, item := range res {
+		pairs := item.([]interface{})
+		fields := make(map[string]interface{})
+		for i := 0; i < len(pairs); i += 2 {
+			fields[pairs[i].(string)] = pairs[i+1]
+		}
+		accounts[fields["section"].(string)] = fields
+	}
+
+	gzh, qy := accounts["gzh"], accounts["qy"]
+	if gzh["type"] != accountOfficial || gzh["app_id"] != testAppId || gzh["secret"] != common.Mask("gzh_secret") || gzh["token_cached"] != int64(1) || gzh["breaker"] != "closed" {
+		t.Fatalf("gzh = %v", gzh)
+	}
+	if _, ok := gzh["wx_card_ticket_cached"]; !ok {
+		t.Fatalf("official account should list wx_card ticket: %v", gzh)
+	}
+	if qy["type"] != accountEnterprise || qy["secret"] != common.Mask("qy_secret") || qy["token_cached"] != int64(0) {
+		t.Fatalf("qy = %v", qy)
+	}
+	if _, ok := qy["wx_card_ticket_cached"]; ok {
+		t.Fatalf("enterprise account should not list wx_card ticket: %v", qy)
+	}
+	if _, ok := accounts["noid"]; !ok {
+		t.Fatalf("accounts = %v", accounts)
+	}
+
+	//RESP3下每个section为map
+	c := dialResp(t)
+	c.send(t, "HELLO 3")
+	c.read(t)
+	c.send(t, "ACCOUNTS")
+	if header, _ := c.rd.ReadString('\n'); header != "*3\r\n" {
+		t.Fatalf("resp3 accounts header = %q", header)
+	}
+	if kind, account := c.readType(t); kind != '%' || !strings.HasPrefix(account, "[section gzh ") {
+		t.Fatalf("resp3 account = %c %s", kind, account)
+	}
+
+	code, body := httpDo(t, http.MethodGet, "/accounts", "")
+	var httpRes struct {
+		Accounts []accountInfo `json:"accounts"`
+	}
+	if err := json.Unmarshal([]byte(body), &httpRes); err != nil || code != http.StatusOK || len(httpRes.Accounts) != 3 {
+		t.Fatalf("/accounts = %d %s", code, body)
+	}
+	if first := httpRes.Accounts[0]; first.Section != "gzh" || first.Secret != common.Mask("gzh_secret") || first.Token == nil || !first.Token.Cached {
+		t.Fatalf("/accounts gzh = %+v", first)
+	}
+
+	for _, secret := range []string{"gzh_secret", "qy_secret", `:"secret"`, " secret secret "} {
+		if strings.Contains(body, secret) || strings.Contains(fmt.Sprint(res), secret) {
+			t.Fatalf("secret %s in accounts: %s %v", secret, body, res)
+		}
+	}
+}
+
+// setupMock mock为mode=mock的公众号 不请求模拟接口
+func setupMock(t *testing.T, mock *MockOptions) *redis.Client {
+	t.Helper()
+
+	rc := setup(t)
+
+	m, err := NewManager(ManagerConfig{
+		Accounts: []Account{
+			{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"},
+			{Name: "mock", AppId: "wx_mock", Mock: mock},
+		},
+		HTTPClient: fake.Client(),
+		OnChange:   valueChanged,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wx.Store(m)
+
+	return rc
+}
+
+func TestMockMode(t *testing.T) {
+	rc := setupMock(t, &MockOptions{ExpiresIn: 600})
+
+	v := doStrings(t, rc, "ztoken", "mock")
+	if v[0] != "MOCK_TOKEN_wx_mock_1" {
+		t.Fatalf("ztoken = %v", v)
+	}
+	if expireAt, _ := strconv.ParseInt(v[1], 10, 64); expireAt > time.Now().Add(600*time.Second).Unix() {
+		t.Fatalf("expireAt = %v, want within 600s", v[1])
+	}
+	if v := do(t, rc, "ticket", "mock"); v != "MOCK_TICKET_wx_mock_JSAPI_2" {
+		t.Fatalf("ticket = %v", v)
+	}
+	if v := do(t, rc, "token", "mock", "1"); v != "MOCK_TOKEN_wx_mock_3" {
+		t.Fatalf("forced token = %v", v)
+	}
+	expectRequests(t, wxtest.Token, 0)
+	expectRequests(t, wxtest.Ticket, 0)
+
+	_, body := httpDo(t, http.MethodGet, "/accounts", "")
+	if !strings.Contains(body, `"mock":true`) {
+		t.Fatalf("accounts should mark mock section: %s", body)
+	}
+}
+
+func TestMockFail(t *testing.T) {
+	//未配置mock时不注册mockfail
+	if _, err := setup(t).Do(context.Background(), "mockfail", "gzh", "45009").Result(); err == nil || !strings.Contains(err.Error(), "unknown command") {
+		t.Fatalf("mockfail without mock section = %v", err)
+	}
+
+	setupMock(t, &MockOptions{})
+
+	addr := freeAddr()
+	rs := newRedisServeMux()
+	go rs.Run(addr, func() {})
+	t.Cleanup(func() { rs.Close() })
+	waitListen(addr)
+
+	rc := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+	t.Cleanup(func() { rc.Close() })
+
+	if _, err := rc.Do(context.Background(), "mockfail", "gzh", "45009").Result(); err == nil {
+		t.Fatal("mockfail on non-mock section should fail")
+	}
+
+	do(t, rc, "mockfail", "mock", "45009", "2")
+	for i := 0; i < 2; i++ {
+		code, body := httpDo(t, http.MethodGet, "/v2/token/mock", "")
+		if code != http.StatusBadGateway || !strings.Contains(body, "45009") {
+			t.Fatalf("v2 token = %d %s", code, body)
+		}
+	}
+	if v := do(t, rc, "token", "mock"); v != "MOCK_TOKEN_wx_mock_1" {
+		t.Fatalf("token after injected failures = %v", v)
+	}
+
+	do(t, rc, "mockfail", "mock", "unreachable")
+	code, body := httpDo(t, http.MethodPost, "/v2/token/mock", "")
+	if code == http.StatusOK || !strings.Contains(body, errUpstreamFail) {
+		t.Fatalf("v2 forced token = %d %s", code, body)
+	}
+
+	m, _ := NewManager(ManagerConfig{Accounts: []Account{{Name: "mock", AppId: "wx_mock", Mock: &MockOptions{ErrCode: 40164}}}})
+	if _, err := m.Token("mock", true); err == nil || err.(*WError).ErrCode != 40164 {
+		t.Fatalf("configured errcode = %v", err)
+	}
+}
+
+func TestManagerCloseCancelsUpstream(t *testing.T) {
+	setup(t)
+
+	client := fake.Client()
+	m, _ := NewManager(ManagerConfig{
+		Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+		HTTPClient: client,
+	})
+
+	fake.Push(wxtest.Token, wxtest.Timeout(5*time.Second))
+	time.AfterFunc(50*time.Millisecond, m.Close)
+
+	startAt := time.Now()
+	_, err := m.Token("gzh", true)
+	if err == nil || err.(*WError).Code != errUpstreamFail {
+		t.Fatalf("token after close = %v", err)
+	}
+	if time.Since(startAt) > time.Second {
+		t.Fatalf("close should cancel upstream request, took %v", time.Since(startAt))
+	}
+}
+
+func retryManager(t *testing.T, policy RetryPolicy) *Manager {
+	t.Helper()
+
+	setup(t)
+
+	m, err := NewManager(ManagerConfig{
+		Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+		HTTPClient: fake.Client(),
+		Retry:      policy,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return m
+}
+
+func TestRetryTransient(t *testing.T) {
+	m := retryManager(t, RetryPolicy{MaxAttempts: 3, Backoff: 10 * time.Millisecond, ErrCodes: []int{-1, 45011}})
+
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrSystemBusy), wxtest.Fail(wxtest.ErrFreqLimit))
+	token, err := m.Token("gzh", true)
+	if err != nil || token.Value() != fake.CurrentToken(testAppId) {
+		t.Fatalf("token = %v %v", token, err)
+	}
+	expectRequests(t, wxtest.Token, 3)
+
+	//不可重试的错误码直接返回
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrIPWhitelist))
+	if _, err := m.Token("gzh", false); err == nil || err.(*WError).ErrCode != wxtest.ErrIPWhitelist.ErrCode {
+		t.Fatalf("token = %v", err)
+	}
+	expectRequests(t, wxtest.Token, 4)
+
+	//超过最多请求次数
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrSystemBusy), wxtest.Fail(wxtest.ErrSystemBusy), wxtest.Fail(wxtest.ErrSystemBusy))
+	if _, err := m.Token("gzh", false); err == nil || err.(*WError).ErrCode != -1 {
+		t.Fatalf("token = %v", err)
+	}
+	expectRequests(t, wxtest.Token, 7)
+}
+
+func TestRetryDeadline(t *testing.T) {
+	m := retryManager(t, RetryPolicy{MaxAttempts: 10, Backoff: 100 * time.Millisecond, Deadline: 300 * time.Millisecond})
+
+	fake.Push(wxtest.Token, wxtest.Timeout(time.Second), wxtest.Timeout(time.Second))
+
+	startAt := time.Now()
+	if _, err := m.Token("gzh", true); err == nil || err.(*WError).Code != errUpstreamFail {
+		t.Fatalf("token = %v", err)
+	}
+	if elapsed := time.Since(startAt); elapsed > 600*time.Millisecond {
+		t.Fatalf("deadline exceeded, took %v", elapsed)
+	}
+}
+
+func TestRetryBackoff(t *testing.T) {
+	tests := []struct {
+		policy   RetryPolicy
+		attempt  int
+		min, max time.Duration
+	}{
+		{RetryPolicy{Backoff: 10 * time.Millisecond}, 1, 5 * time.Millisecond, 10 * time.Millisecond},
+		//未配置上限时每次翻倍
+		{RetryPolicy{Backoff: 10 * time.Millisecond}, 4, 40 * time.Millisecond, 80 * time.Millisecond},
+		{RetryPolicy{Backoff: 10 * time.Millisecond, MaxBackoff: 30 * time.Millisecond}, 4, 15 * time.Millisecond, 30 * time.Millisecond},
+		{RetryPolicy{Backoff: time.Hour}, 100, 0, time.Duration(math.MaxInt64)},
+		{RetryPolicy{}, 3, 0, 0},
+	}
+
+	for _, tt := range tests {
+		for i := 0; i < 20; i++ {
+			if d := tt.policy.backoff(tt.attempt); d < tt.min || d > tt.max {
+				t.Fatalf("backoff(%+v, %d) = %v, want [%v,%v]", tt.policy, tt.attempt, d, tt.min, tt.max)
+			}
+		}
+	}
+}
+
+// 不可重试的错误码及无法解析的响应同样计为失败 熔断后/v2返回503
+func TestBreakerFailures(t *testing.T) {
+	tests := []struct {
+		name     string
+		behavior wxtest.Behavior
+	}{
+		{"ip_whitelist", wxtest.Fail(wxtest.ErrIPWhitelist)},
+		{"malformed", wxtest.Behavior{Body: "<html>bad gateway</html>"}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+
+			m, err := NewManager(ManagerConfig{
+				Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+				HTTPClient: fake.Client(),
+				Retry:      RetryPolicy{MaxAttempts: 1},
+				Breaker:    BreakerPolicy{Threshold: 2, Cooldown: 30 * time.Second},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			wx.Store(m)
+
+			fake.Push(wxtest.Token, tt.behavior, tt.behavior)
+			for i := 0; i < 2; i++ {
+				if _, err := m.Token("gzh", true); err == nil {
+					t.Fatal("token should fail")
+				}
+			}
+			if state := m.BreakerState("gzh"); state != breakerOpen {
+				t.Fatalf("breaker = %s, want open", state)
+			}
+
+			code, body := httpDo(t, http.MethodGet, "/v2/token/gzh", "")
+			if code != http.StatusServiceUnavailable || !strings.Contains(body, errCircuitOpen) {
+				t.Fatalf("v2 token while open = %d %s", code, body)
+			}
+			expectRequests(t, wxtest.Token, 2)
+		})
+	}
+}
+
+// 获取ticket时token及ticket的请求共用同一个deadline
+func TestRetryDeadlineTicket(t *testing.T) {
+	m := retryManager(t, RetryPolicy{MaxAttempts: 10, Backoff: 20 * time.Millisecond, ErrCodes: []int{-1}, Deadline: 400 * time.Millisecond})
+
+	fake.Push(wxtest.Token, wxtest.Timeout(250*time.Millisecond))
+	busy := make([]wxtest.Behavior, 20)
+	for i := range busy {
+		busy[i] = wxtest.Fail(wxtest.ErrSystemBusy)
+	}
+	fake.Push(wxtest.Ticket, busy...)
+
+	startAt := time.Now()
+	if _, err := m.Ticket("gzh", ticketJsapi, true); err == nil || err.(*WError).ErrCode != -1 {
+		t.Fatalf("ticket = %v", err)
+	}
+	if elapsed := time.Since(startAt); elapsed > 550*time.Millisecond {
+		t.Fatalf("deadline exceeded, took %v", elapsed)
+	}
+	expectRequests(t, wxtest.Token, 1)
+}
+
+func TestBreaker(t *testing.T) {
+	setup(t)
+
+	now := time.Now()
+	m, err := NewManager(ManagerConfig{
+		Accounts:   []Account{{Name: "gzh", AppId: testAppId, AppSecret: "gzh_secret"}},
+		HTTPClient: fake.Client(),
+		Retry:      RetryPolicy{MaxAttempts: 1, ErrCodes: []int{-1}},
+		Breaker:    BreakerPolicy{Threshold: 2, Cooldown: 30 * time.Second},
+		Clock:      func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	token, err := m.Token("gzh", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	//连续失败后熔断 强制刷新返回仍有效的缓存值
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrSystemBusy), wxtest.Fail(wxtest.ErrSystemBusy))
+	m.Token("gzh", false)
+	m.Token("gzh", false)
+	if state := m.BreakerState("gzh"); state != breakerOpen {
+		t.Fatalf("breaker = %s, want open", state)
+	}
+
+	cached, err := m.Token("gzh", false)
+	if err != nil || cached.Value() != token.Value() || cached.Source() != sourceCache {
+		t.Fatalf("token while open = %v %v", cached, err)
+	}
+	expectRequests(t, wxtest.Token, 3)
+
+	//没有缓存时直接返回熔断错误
+	if _, err := m.Ticket("gzh", ticketJsapi, true); err == nil || err.(*WError).Code != errCircuitOpen {
+		t.Fatalf("ticket while open = %v", err)
+	}
+	expectRequests(t, wxtest.Ticket, 0)
+
+	//冷却结束后探测失败 重新熔断
+	now = now.Add(31 * time.Second)
+	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrSystemBusy))
+	m.Token("gzh", false)
+	if state := m.BreakerState("gzh"); state != breakerOpen {
+		t.Fatalf("breaker after failed probe = %s, want open", state)
+	}
+	expectRequests(t, wxtest.Token, 4)
+
+	//探测成功后恢复
+	now = now.Add(31 * time.Second)
+	if _, err := m.Token("gzh", false); err != nil {
+		t.Fatal(err)
+	}
+	if state := m.BreakerState("gzh"); state != breakerClosed {
+		t.Fatalf("breaker after probe = %s, want closed", state)
+	}
+}
+
+type failStorage struct {
+	Storage
+}
+
+func (failStorage) Name() string { return "fail" }
+
+func (failStorage) Load() (*Snapshot, error) { return nil, fmt.Errorf("load fail") }
+
+func TestRunInitLoadFail(t *testing.T) {
+	setup(t)
+	loaded := dataLoaded.Load()
+	t.Cleanup(func() { dataLoaded.Store(loaded) })
+
+	dataLoaded.Store(false)
+	m, err := NewManager(ManagerConfig{Storage: failStorage{}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wx.Store(m)
+	RunInit()
+	if dataLoaded.Load() {
+		t.Fatal("data should not be loaded when storage load fails")
+	}
+
+	setup(t)
+	RunInit()
+	if !dataLoaded.Load() {
+		t.Fatal("data should be loaded without storage")
+	}
+}
+
+func TestRunInitMissingDataFile(t *testing.T) {
+	setup(t)
+	loaded := dataLoaded.Load()
+	t.Cleanup(func() { dataLoaded.Store(loaded) })
+
+	storage, err := NewFileStorage(filepath.Join(t.TempDir(), "data.dat"), 2, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { storage.Close() })
+
+	m, err := NewManager(ManagerConfig{Storage: storage})
+	if err != nil {
+		t.Fatal(err)
+	}
+	wx.Store(m)
+
+	dataLoaded.Store(false)
+	RunInit()
+	if !dataLoaded.Load() {
+		t.Fatal("data should be loaded when data file not exist")
+	}
+}
+
+func TestRespServeMuxReady(t *testing.T) {
+	//地址已被占用时不通知就绪
+	rs := newRespServeMux()
+	if err := rs.Run(respAddr, func() { t.Error("ready on bind failure") }); err == nil {
+		t.Fatal("run on used address should fail")
+	}
+
+	addr := freeAddr()
+	ready := make(chan struct{})
+	rs = newRespServeMux()
+	rs.Handle("ping", func(conn redcon.Conn, cmd redcon.Command) { conn.WriteString("PONG") })
+	go rs.Run(addr, func() { close(ready) })
+	defer rs.Close()
+
+	select {
+	case <-ready:
+	case <-time.After(time.Second):
+		t.Fatal("ready not called")
+	}
+
+	rc := redis.NewClient(&redis.Options{Addr: addr, Protocol: 2})
+	defer rc.Close()
+	if v, err := rc.Ping(context.Background()).Result(); err != nil || v != "PONG" {
+		t.Fatalf("ping = %v %v", v, err)
+	}
+}
+
+type syncBuffer struct {
+	sync.Mutex
+	lines []string
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	b.lines = append(b.lines, string(p))
+	return len(p), nil
+}
+
+// waitLine 等待包含command的访问日志 日志在回复后写入
+func (b *syncBuffer) waitLine(t *testing.T, command string) map[string]interface{} {
+	t.Helper()
+
+	for i := 0; i < 50; i++ {
+		b.Lock()
+		for _, line := range b.lines {
+			var entry map[string]interface{}
+			if json.Unmarshal([]byte(line), &entry) == nil && entry["command"] == command {
+				b.Unlock()
+				return entry
+			}
+		}
+		b.Unlock()
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	t.Fatalf("access log of %s not found", command)
+	return nil
+}
+
+func TestAccessSection(t *testing.T) {
+	rc := setup(t)
+
+	buf := &syncBuffer{}
+	common.SetupLogger("text", "info", io.Discard)
+	common.SetupAccessLogger("json", buf)
+	t.Cleanup(func() {
+		common.SetupLogger("text", "error", io.Discard)
+		common.SetupAccessLogger("text", io.Discard)
+	})
+
+	do(t, rc, "echo", "gzh")
+	do(t, rc, "token", "gzh")
+	do(t, rc, "get", "ticket:gzh")
+	do(t, rc, "keys", "*")
+
+	for command, section := range map[string]string{"echo": "", "token": "gzh", "get": "gzh", "keys": ""} {
+		if entry := buf.waitLine(t, command); entry["section"] != section {
+			t.Errorf("%s section = %v, want %q", command, entry["section"], section)
+		}
+	}
+}
+
+// parseTestConfig 解析仅含给定section的配置文件 结束后恢复全局配置及日志
+func parseTestConfig(t *testing.T, sections string) error {
+	t.Helper()
+
+	saved := *common.Config
+	t.Cleanup(func() {
+		*common.Config = saved
+		common.SetupLogger("text", "error", io.Discard)
+		common.SetupAccessLogger("text", io.Discard)
+	})
+
+	path := t.TempDir() + "/weixin.ini"
+	content := fmt.Sprintf("[DEFAULT]\nweb=%s\nredis=%s\nlog_level=error\naccess_log=off\n\n%s", webAddr, respAddr, sections)
+	if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	_, err := common.ParseConfig(path)
+	return err
+}
+
+// is_enterprise未配置或配置错误时只有该section的请求失败 其他section正常
+func TestConfigAccountsIsEnterprise(t *testing.T) {
+	tests := []struct {
+		name    string
+		section string
+		want    bool
+		wantErr bool
+	}{
+		{"gzh", "is_enterprise=0", false, false},
+		{"qy", "is_enterprise=1", true, false},
+		{"missing", "", false, true},
+		{"empty", "is_enterprise=", false, true},
+		{"invalid", "is_enterprise=maybe", false, true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			setup(t)
+			config := fmt.Sprintf("[ok]\napp_id=%s\napp_secret=gzh_secret\nis_enterprise=0\n\n[%s]\napp_id=wx_%s\napp_secret=secret\n%s\n", testAppId, tt.name, tt.name, tt.section)
+			if err := parseTestConfig(t, config); err != nil {
+				t.Fatal(err)
+			}
+
+			accounts, err := configAccounts()
+			if err != nil || len(accounts) != 2 {
+				t.Fatalf("accounts = %+v %v", accounts, err)
+			}
+			m, err := NewManager(ManagerConfig{Accounts: accounts, HTTPClient: fake.Client()})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			account, _ := m.Account(tt.name)
+			_, err = m.Token(tt.name, true)
+			if tt.wantErr {
+				var werr *WError
+				if !errors.As(err, &werr) || werr.Code != errInvalidConfig || !strings.Contains(werr.Error(), "invalid is_enterprise of "+tt.name) {
+					t.Fatalf("token err = %v", err)
+				}
+			} else if account.IsEnterprise != tt.want || len(account.ConfigError) > 0 {
+				t.Fatalf("account = %+v", account)
+			}
+
+			if v, err := m.Token("ok", true); err != nil || v.Value() != fake.CurrentToken(testAppId) {
+				t.Fatalf("other section token = %v %v", v, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package core
+
+import (
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"strings"
+)
+
+const nonceChars = "abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ0123456789"
+
+// JsSign JS-SDK wx.config所需的签名参数
+type JsSign struct {
+	AppId     string
+	NonceStr  string
+	Timestamp int64
+	Url       string
+	Signature string
+}
+
+func nonceStr(n int) string {
+	b := make([]byte, n)
+	rand.Read(b)
+	for i := range b {
+		b[i] = nonceChars[int(b[i])%len(nonceChars)]
+	}
+	return string(b)
+}
+
+// Sign 使用jsapi ticket对url签名 nonce为空或timestamp为0时自动生成
+// https://developers.weixin.qq.com/doc/offiaccount/OA_Web_Apps/JS-SDK.html#62
+func (m *Manager) Sign(name, url, nonce string, timestamp int64) (*JsSign, error) {
+	if len(url) == 0 {
+		return nil, newWError(errInvalidArgument, "url is empty")
+	}
+
+	wxValue, err := m.Ticket(name, ticketJsapi, true)
+	if err != nil {
+		return nil, err
+	}
+
+	if len(nonce) == 0 {
+		nonce = nonceStr(16)
+	}
+	if timestamp == 0 {
+		timestamp = m.now().Unix()
+	}
+
+	//签名url不包含#及其后面部分
+	if i := strings.IndexByte(url, '#'); i >= 0 {
+		url = url[:i]
+	}
+
+	raw := fmt.Sprintf("jsapi_ticket=%s&noncestr=%s&timestamp=%d&url=%s", wxValue.value, nonce, timestamp, url)
+	sum := sha1.Sum([]byte(raw))
+
+	return &JsSign{
+		AppId:     m.AppId(name),
+		NonceStr:  nonce,
+		Timestamp: timestamp,
+		Url:       url,
+		Signature: hex.EncodeToString(sum[:]),
+	}, nil
+}
+
+func Sign(name, url, nonce string, timestamp int64) (*JsSign, error) {
+	return manager().Sign(name, url, nonce, timestamp)
+}
@@ -0,0 +1,141 @@
+package core
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+	"weixin/common"
+)
+
+const (
+	kindToken  = "token"
+	kindTicket = "ticket"
+)
+
+// Snapshot 缓存快照 key为appId
+type Snapshot struct {
+	Tokens  map[string]*WValues
+	Tickets map[string]*WValues
+}
+
+func newSnapshot() *Snapshot {
+	return &Snapshot{
+		Tokens:  make(map[string]*WValues),
+		Tickets: make(map[string]*WValues),
+	}
+}
+
+// Storage token&ticket持久化存储
+type Storage interface {
+	Name() string
+	Load() (*Snapshot, error)
+	Save(snapshot *Snapshot) error
+	Close() error
+}
+
+// StorageConfig 存储配置 对应配置文件中的storage等项
+type StorageConfig struct {
+	// Type 为file,bolt,redis 为空时使用file
+	Type          string
+	DataFile      string
+	DataBackups   int
+	Path          string
+	Redis         string
+	RedisPassword string
+	RedisDB       int
+	Prefix        string
+	// DataKey 不为空时加密存储
+	DataKey string
+}
+
+// NewStorage 根据配置创建存储 未配置时使用data_file
+func NewStorage(cfg StorageConfig) (Storage, error) {
+	switch cfg.Type {
+	case "", "file":
+		if len(cfg.DataFile) == 0 {
+			common.Logger.Warn("not found data file")
+			return nil, nil
+		}
+		return NewFileStorage(cfg.DataFile, cfg.DataBackups, cfg.DataKey)
+	case "bolt":
+		//data_file为json格式 不能作为bolt数据库打开
+		if len(cfg.Path) == 0 {
+			return nil, errors.New("storage bolt need storage_path")
+		}
+		if cfg.Path == cfg.DataFile {
+			return nil, errors.New("storage_path of bolt must differ from data_file")
+		}
+		return NewBoltStorage(cfg.Path, cfg.DataKey)
+	case "redis":
+		if len(cfg.Redis) == 0 {
+			return nil, errors.New("storage redis need storage_redis")
+		}
+		return NewRedisStorage(cfg.Redis, cfg.RedisPassword, cfg.RedisDB, cfg.Prefix, cfg.DataKey)
+	}
+
+	return nil, fmt.Errorf("unknown storage %s", cfg.Type)
+}
+
+// storageEntry 单条记录的存储格式 用于bolt和redis
+type storageEntry struct {
+	ExpireAt  int64  `json:"expireAt"`
+	RefreshAt int64  `json:"refreshAt,omitempty"`
+	Value     string `json:"value"`
+}
+
+func encodeEntry(dataKey string, v *WValues) ([]byte, error) {
+	data, err := json.Marshal(storageEntry{ExpireAt: v.expireAt.Unix(), RefreshAt: unixOrZero(v.refreshAt), Value: v.value})
+	if err != nil {
+		return nil, err
+	}
+
+	if len(dataKey) > 0 {
+		return common.EncryptData(dataKey, data)
+	}
+
+	return data, nil
+}
+
+func decodeEntry(dataKey string, data []byte) (*WValues, error) {
+	if common.IsEncrypted(data) {
+		if len(dataKey) == 0 {
+			return nil, errors.New("entry is encrypted but data_key not configured")
+		}
+
+		var err error
+		data, err = common.DecryptData(dataKey, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	var entry storageEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		return nil, err
+	}
+
+	return &WValues{
+		expireAt:  time.Unix(entry.ExpireAt, 0),
+		refreshAt: timeOrZero(entry.RefreshAt),
+		value:     entry.Value,
+	}, nil
+}
+
+// timeOrZero 旧版本记录没有刷新时间
+func timeOrZero(sec int64) time.Time {
+	if sec == 0 {
+		return time.Time{}
+	}
+	return time.Unix(sec, 0)
+}
+
+// SharedStorage 多实例共享的存储 用于集群模式
+type SharedStorage interface {
+	Storage
+	Get(kind, appId string) (*WValues, error)
+	Set(kind, appId string, v *WValues) error
+	// AcquireLease 获取或续约appId的刷新权 owner已持有时延长有效期
+	AcquireLease(appId, owner string, ttl time.Duration) (bool, error)
+	ReleaseLease(appId, owner string) error
+}
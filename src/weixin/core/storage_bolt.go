@@ -0,0 +1,92 @@
+package core
+
+import (
+	"go.etcd.io/bbolt"
+	"time"
+)
+
+// BoltStorage 使用内嵌bbolt数据库 每个appId单独一条记录
+type BoltStorage struct {
+	db      *bbolt.DB
+	dataKey string
+}
+
+func NewBoltStorage(path, dataKey string) (*BoltStorage, error) {
+	//文件锁由bbolt负责 避免多个实例同时打开
+	db, err := bbolt.Open(path, 0600, &bbolt.Options{Timeout: time.Second})
+	if err != nil {
+		return nil, err
+	}
+
+	err = db.Update(func(tx *bbolt.Tx) error {
+		for _, kind := range []string{kindToken, kindTicket} {
+			if _, err := tx.CreateBucketIfNotExists([]byte(kind)); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return &BoltStorage{db: db, dataKey: dataKey}, nil
+}
+
+func (s *BoltStorage) Name() string {
+	return "bolt"
+}
+
+func (s *BoltStorage) Load() (*Snapshot, error) {
+	snapshot := newSnapshot()
+
+	err := s.db.View(func(tx *bbolt.Tx) error {
+		for kind, values := range map[string]map[string]*WValues{kindToken: snapshot.Tokens, kindTicket: snapshot.Tickets} {
+			err := tx.Bucket([]byte(kind)).ForEach(func(k, v []byte) error {
+				wxValue, err := decodeEntry(s.dataKey, v)
+				if err != nil {
+					return err
+				}
+				values[string(k)] = wxValue
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+
+	return snapshot, err
+}
+
+func (s *BoltStorage) Save(snapshot *Snapshot) error {
+	return s.db.Update(func(tx *bbolt.Tx) error {
+		for kind, values := range map[string]map[string]*WValues{kindToken: snapshot.Tokens, kindTicket: snapshot.Tickets} {
+			if err := tx.DeleteBucket([]byte(kind)); err != nil {
+				return err
+			}
+
+			bucket, err := tx.CreateBucket([]byte(kind))
+			if err != nil {
+				return err
+			}
+
+			for appId, wxValue := range values {
+				data, err := encodeEntry(s.dataKey, wxValue)
+				if err != nil {
+					return err
+				}
+				if err = bucket.Put([]byte(appId), data); err != nil {
+					return err
+				}
+			}
+		}
+		return nil
+	})
+}
+
+func (s *BoltStorage) Close() error {
+	return s.db.Close()
+}
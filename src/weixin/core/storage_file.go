@@ -0,0 +1,111 @@
+package core
+
+import (
+	"bytes"
+	"github.com/karlseguin/jsonwriter"
+	"github.com/tidwall/gjson"
+	"os"
+	"time"
+	"weixin/common"
+)
+
+// FileStorage 整体写入单个json文件
+type FileStorage struct {
+	path    string
+	backups int
+	dataKey string
+	lock    *os.File
+}
+
+func NewFileStorage(path string, backups int, dataKey string) (*FileStorage, error) {
+	lock, err := lockDataFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &FileStorage{
+		path:    path,
+		backups: backups,
+		dataKey: dataKey,
+		lock:    lock,
+	}, nil
+}
+
+func (s *FileStorage) Name() string {
+	return "file"
+}
+
+func (s *FileStorage) Load() (*Snapshot, error) {
+	jsonResult, err := readDataFile(s.path, s.backups, s.dataKey)
+	//首次部署时数据文件及备份均不存在 视为空数据
+	if os.IsNotExist(err) {
+		common.Logger.Info("data file not exist, start with empty data", "path", s.path)
+		return newSnapshot(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot := newSnapshot()
+
+	jsonResult.Get("tokens").ForEach(func(key, value gjson.Result) bool {
+		snapshot.Tokens[key.String()] = &WValues{
+			expireAt:  time.Unix(value.Get("expireAt").Int(), 0),
+			refreshAt: timeOrZero(value.Get("refreshAt").Int()),
+			value:     value.Get("token").String(),
+		}
+		return true
+	})
+
+	jsonResult.Get("tickets").ForEach(func(key, value gjson.Result) bool {
+		snapshot.Tickets[key.String()] = &WValues{
+			expireAt:  time.Unix(value.Get("expireAt").Int(), 0),
+			refreshAt: timeOrZero(value.Get("refreshAt").Int()),
+			value:     value.Get("ticket").String(),
+		}
+		return true
+	})
+
+	return snapshot, nil
+}
+
+func (s *FileStorage) Save(snapshot *Snapshot) error {
+	buffer := new(bytes.Buffer)
+	jWriter := jsonwriter.New(buffer)
+	jWriter.RootObject(func() {
+		jWriter.KeyValue("time", time.Now().Unix())
+		jWriter.Object("tokens", func() {
+			for k, v := range snapshot.Tokens {
+				jWriter.Object(k, func() {
+					jWriter.KeyValue("expireAt", v.expireAt.Unix())
+					jWriter.KeyValue("refreshAt", unixOrZero(v.refreshAt))
+					jWriter.KeyValue("token", v.value)
+				})
+			}
+		})
+		jWriter.Object("tickets", func() {
+			for k, v := range snapshot.Tickets {
+				jWriter.Object(k, func() {
+					jWriter.KeyValue("expireAt", v.expireAt.Unix())
+					jWriter.KeyValue("refreshAt", unixOrZero(v.refreshAt))
+					jWriter.KeyValue("ticket", v.value)
+				})
+			}
+		})
+	})
+
+	content := buffer.Bytes()
+	if len(s.dataKey) > 0 {
+		var err error
+		content, err = common.EncryptData(s.dataKey, content)
+		if err != nil {
+			return err
+		}
+	}
+
+	return writeDataFile(s.path, content, s.backups)
+}
+
+func (s *FileStorage) Close() error {
+	return s.lock.Close()
+}
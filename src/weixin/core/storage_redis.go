@@ -0,0 +1,206 @@
+package core
+
+import (
+	"context"
+	"github.com/redis/go-redis/v9"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisStorageTimeout = 5 * time.Second
+
+// RedisStorage 使用外部redis存储 可在多台服务器间共享
+// key格式为{prefix}{kind}:{appId} 过期时间与token/ticket一致
+// written记录本实例加载或写入过的key Save时删除其中不在快照里的key 不影响其他实例写入的key
+type RedisStorage struct {
+	client  *redis.Client
+	prefix  string
+	dataKey string
+	mu      sync.Mutex
+	written map[string]struct{}
+}
+
+func NewRedisStorage(address, password string, db int, prefix, dataKey string) (*RedisStorage, error) {
+	client := redis.NewClient(&redis.Options{
+		Addr:     address,
+		Password: password,
+		DB:       db,
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, err
+	}
+
+	return &RedisStorage{
+		client:  client,
+		prefix:  prefix,
+		dataKey: dataKey,
+		written: make(map[string]struct{}),
+	}, nil
+}
+
+func (s *RedisStorage) Name() string {
+	return "redis"
+}
+
+func (s *RedisStorage) key(kind, appId string) string {
+	return s.prefix + kind + ":" + appId
+}
+
+func (s *RedisStorage) Load() (*Snapshot, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	snapshot := newSnapshot()
+
+	for kind, values := range map[string]map[string]*WValues{kindToken: snapshot.Tokens, kindTicket: snapshot.Tickets} {
+		keyPrefix := s.key(kind, "")
+		iter := s.client.Scan(ctx, 0, keyPrefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			data, err := s.client.Get(ctx, iter.Val()).Bytes()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+
+			wxValue, err := decodeEntry(s.dataKey, data)
+			if err != nil {
+				return nil, err
+			}
+			values[strings.TrimPrefix(iter.Val(), keyPrefix)] = wxValue
+			s.wrote(iter.Val())
+		}
+		if err := iter.Err(); err != nil {
+			return nil, err
+		}
+	}
+
+	return snapshot, nil
+}
+
+func (s *RedisStorage) Save(snapshot *Snapshot) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	keys := make(map[string]struct{})
+	pipe := s.client.TxPipeline()
+	for kind, values := range map[string]map[string]*WValues{kindToken: snapshot.Tokens, kindTicket: snapshot.Tickets} {
+		for appId, wxValue := range values {
+			data, err := encodeEntry(s.dataKey, wxValue)
+			if err != nil {
+				return err
+			}
+			key := s.key(kind, appId)
+			keys[key] = struct{}{}
+			pipe.SetArgs(ctx, key, data, redis.SetArgs{ExpireAt: wxValue.expireAt})
+		}
+	}
+
+	//已清除的token及ticket 避免重启后重新加载
+	removed := make([]string, 0)
+	for key := range s.written {
+		if _, ok := keys[key]; !ok {
+			removed = append(removed, key)
+		}
+	}
+	if len(removed) > 0 {
+		pipe.Del(ctx, removed...)
+	}
+
+	if _, err := pipe.Exec(ctx); err != nil {
+		return err
+	}
+
+	s.written = keys
+
+	return nil
+}
+
+func (s *RedisStorage) wrote(key string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.written[key] = struct{}{}
+}
+
+func (s *RedisStorage) Close() error {
+	return s.client.Close()
+}
+
+func (s *RedisStorage) Get(kind, appId string) (*WValues, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	data, err := s.client.Get(ctx, s.key(kind, appId)).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return decodeEntry(s.dataKey, data)
+}
+
+func (s *RedisStorage) Set(kind, appId string, v *WValues) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	data, err := encodeEntry(s.dataKey, v)
+	if err != nil {
+		return err
+	}
+
+	if err = s.client.SetArgs(ctx, s.key(kind, appId), data, redis.SetArgs{ExpireAt: v.expireAt}).Err(); err != nil {
+		return err
+	}
+	s.wrote(s.key(kind, appId))
+
+	return nil
+}
+
+var acquireLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("PEXPIRE", KEYS[1], ARGV[2])
+end
+if redis.call("SET", KEYS[1], ARGV[1], "NX", "PX", ARGV[2]) then
+	return 1
+end
+return 0
+`)
+
+var releaseLeaseScript = redis.NewScript(`
+if redis.call("GET", KEYS[1]) == ARGV[1] then
+	return redis.call("DEL", KEYS[1])
+end
+return 0
+`)
+
+func (s *RedisStorage) AcquireLease(appId, owner string, ttl time.Duration) (bool, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	n, err := acquireLeaseScript.Run(ctx, s.client, []string{s.key("lease", appId)}, owner, ttl.Milliseconds()).Int()
+	if err != nil {
+		return false, err
+	}
+
+	return n == 1, nil
+}
+
+func (s *RedisStorage) ReleaseLease(appId, owner string) error {
+	ctx, cancel := context.WithTimeout(context.Background(), redisStorageTimeout)
+	defer cancel()
+
+	return releaseLeaseScript.Run(ctx, s.client, []string{s.key("lease", appId)}, owner).Err()
+}
@@ -0,0 +1,185 @@
+package core
+
+import (
+	"github.com/alicebob/miniredis/v2"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testSnapshot(tokens, tickets map[string]string) *Snapshot {
+	snapshot := newSnapshot()
+	expireAt := time.Now().Add(time.Hour).Truncate(time.Second)
+	for dst, src := range map[*map[string]*WValues]map[string]string{&snapshot.Tokens: tokens, &snapshot.Tickets: tickets} {
+		for key, value := range src {
+			(*dst)[key] = &WValues{value: value, expireAt: expireAt, refreshAt: expireAt.Add(-time.Hour)}
+		}
+	}
+	return snapshot
+}
+
+func expectSnapshot(t *testing.T, s Storage, tokens, tickets map[string]string) {
+	t.Helper()
+
+	snapshot, err := s.Load()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for kind, want := range map[string]map[string]string{kindToken: tokens, kindTicket: tickets} {
+		got := snapshot.Tokens
+		if kind == kindTicket {
+			got = snapshot.Tickets
+		}
+		if len(got) != len(want) {
+			t.Fatalf("%s %s = %v, want %v", s.Name(), kind, got, want)
+		}
+		for key, value := range want {
+			if v, ok := got[key]; !ok || v.value != value {
+				t.Fatalf("%s %s %s = %v, want %s", s.Name(), kind, key, v, value)
+			}
+		}
+	}
+}
+
+// testStorage 保存后加载一致 快照中已移除的记录不再加载
+func testStorage(t *testing.T, s Storage) {
+	if err := s.Save(testSnapshot(map[string]string{"wx1": "TOKEN1", "wx2": "TOKEN2"}, map[string]string{"wx2": "TICKET2", "wx1:wx_card": "TICKET_CARD1"})); err != nil {
+		t.Fatal(err)
+	}
+	expectSnapshot(t, s, map[string]string{"wx1": "TOKEN1", "wx2": "TOKEN2"}, map[string]string{"wx2": "TICKET2", "wx1:wx_card": "TICKET_CARD1"})
+
+	//40001后清除token及dropTickets清除ticket
+	if err := s.Save(testSnapshot(map[string]string{"wx1": "TOKEN1_NEW"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	expectSnapshot(t, s, map[string]string{"wx1": "TOKEN1_NEW"}, map[string]string{})
+}
+
+func TestFileStorage(t *testing.T) {
+	s, err := NewFileStorage(filepath.Join(t.TempDir(), "data.dat"), 1, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStorage(t, s)
+}
+
+func TestBoltStorage(t *testing.T) {
+	s, err := NewBoltStorage(filepath.Join(t.TempDir(), "data.db"), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStorage(t, s)
+}
+
+func TestRedisStorage(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	s, err := NewRedisStorage(mr.Addr(), "", 0, "weixin:", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+
+	testStorage(t, s)
+
+	if mr.Exists("weixin:token:wx2") || mr.Exists("weixin:ticket:wx2") || mr.Exists("weixin:ticket:wx1:wx_card") {
+		t.Fatalf("removed keys still in redis: %v", mr.Keys())
+	}
+	if ttl := mr.TTL("weixin:token:wx1"); ttl <= 0 || ttl > time.Hour {
+		t.Fatalf("ttl = %v", ttl)
+	}
+}
+
+// 重启后加载的key同样在之后清除 其他实例写入的key保持不变
+func TestRedisStorageRestart(t *testing.T) {
+	mr := miniredis.RunT(t)
+
+	first, _ := NewRedisStorage(mr.Addr(), "", 0, "weixin:", "")
+	first.Save(testSnapshot(map[string]string{"wx1": "TOKEN1"}, map[string]string{"wx1": "TICKET1"}))
+	first.Close()
+
+	s, _ := NewRedisStorage(mr.Addr(), "", 0, "weixin:", "")
+	defer s.Close()
+	if _, err := s.Load(); err != nil {
+		t.Fatal(err)
+	}
+
+	other, _ := NewRedisStorage(mr.Addr(), "", 0, "weixin:", "")
+	defer other.Close()
+	other.Set(kindToken, "wx_other", &WValues{value: "TOKEN_OTHER", expireAt: time.Now().Add(time.Hour)})
+
+	if err := s.Save(testSnapshot(map[string]string{"wx1": "TOKEN1"}, nil)); err != nil {
+		t.Fatal(err)
+	}
+	if mr.Exists("weixin:ticket:wx1") {
+		t.Fatal("ticket loaded before restart should be removed")
+	}
+	if !mr.Exists("weixin:token:wx_other") {
+		t.Fatal("key written by other instance should be kept")
+	}
+}
+
+// 加密存储使用各自的data_key 不读取全局配置
+func TestEncryptedStorage(t *testing.T) {
+	dir := t.TempDir()
+	bolt := filepath.Join(dir, "data.db")
+
+	s, err := NewBoltStorage(bolt, "secret_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	testStorage(t, s)
+	s.Close()
+
+	wrong, err := NewBoltStorage(bolt, "other_key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer wrong.Close()
+	if _, err := wrong.Load(); err == nil {
+		t.Fatal("load with wrong data_key should fail")
+	}
+
+	m, err := NewManager(ManagerConfig{
+		StorageConfig: &StorageConfig{DataFile: filepath.Join(dir, "data.dat"), DataKey: "secret_key"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	m.store(kindToken, "wx1", &WValues{value: "TOKEN1", expireAt: time.Now().Add(time.Hour)})
+	m.Save()
+	m.Close()
+
+	if _, err := readDataFile(filepath.Join(dir, "data.dat"), 0, ""); err == nil {
+		t.Fatal("data file should be encrypted")
+	}
+	if result, err := readDataFile(filepath.Join(dir, "data.dat"), 0, "secret_key"); err != nil || result.Get("tokens.wx1.token").String() != "TOKEN1" {
+		t.Fatalf("data file = %v %v", result, err)
+	}
+}
+
+// bolt必须配置storage_path 不使用data_file
+func TestNewStorageBoltPath(t *testing.T) {
+	dir := t.TempDir()
+
+	if _, err := NewStorage(StorageConfig{Type: "bolt", DataFile: filepath.Join(dir, "data.dat")}); err == nil {
+		t.Fatal("bolt without storage_path should fail")
+	}
+	if _, err := NewStorage(StorageConfig{Type: "bolt", DataFile: filepath.Join(dir, "data.dat"), Path: filepath.Join(dir, "data.dat")}); err == nil {
+		t.Fatal("bolt on data_file should fail")
+	}
+
+	s, err := NewStorage(StorageConfig{Type: "bolt", DataFile: filepath.Join(dir, "data.dat"), Path: filepath.Join(dir, "data.db")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer s.Close()
+	if s.Name() != "bolt" {
+		t.Fatalf("storage = %s", s.Name())
+	}
+}
@@ -0,0 +1,259 @@
+package core
+
+import (
+	"fmt"
+	"github.com/tidwall/redcon"
+	"strings"
+	"sync"
+	"time"
+	"weixin/common"
+)
+
+const (
+	trackingQueueSize    = 1024
+	trackingWriteTimeout = time.Second
+)
+
+// clientTracking CLIENT TRACKING状态 默认模式记录读取过的键 失效通知后移除
+// BCAST模式按前缀广播 未指定前缀时所有键变化均通知
+type clientTracking struct {
+	enabled  bool
+	bcast    bool
+	noloop   bool
+	prefixes []string
+	keys     map[string]bool
+	busy     bool
+	pending  []string
+}
+
+var invalidations = make(chan string, trackingQueueSize)
+
+var trackingOnce sync.Once
+
+func startTracking() {
+	trackingOnce.Do(func() {
+		go func() {
+			for key := range invalidations {
+				pushInvalidate(key)
+			}
+		}()
+	})
+}
+
+// invalidateValue token或ticket被替换时通知开启CLIENT TRACKING的客户端
+func invalidateValue(kind, section, ticketType string) {
+	vk := &virtualKey{kind: kind, section: section, ticketType: ticketType}
+	if kind == kindTicket && len(ticketType) == 0 {
+		vk.ticketType = ticketJsapi
+	}
+
+	select {
+	case invalidations <- vk.String():
+	default:
+		common.Logger.Warn("tracking invalidation queue full", "key", vk.String())
+	}
+}
+
+func trackingClients() []*respClient {
+	respClients.Lock()
+	defer respClients.Unlock()
+
+	clients := make([]*respClient, 0)
+	for _, client := range respClients.m {
+		clients = append(clients, client)
+	}
+	return clients
+}
+
+func pushInvalidate(key string) {
+	for _, client := range trackingClients() {
+		if err := client.push(key); err != nil {
+			common.Logger.Debug("push invalidate fail", "client", client.addr, "key", key, "err", err)
+		}
+	}
+}
+
+// wants 判断是否需要通知 默认模式下通知后不再跟踪该键
+func (t *clientTracking) wants(key string) bool {
+	if !t.enabled {
+		return false
+	}
+
+	if t.bcast {
+		if len(t.prefixes) == 0 {
+			return true
+		}
+		for _, prefix := range t.prefixes {
+			if strings.HasPrefix(key, prefix) {
+				return true
+			}
+		}
+		return false
+	}
+
+	if !t.keys[key] {
+		return false
+	}
+	delete(t.keys, key)
+
+	return true
+}
+
+// remember 记录客户端读取过的键
+func (t *clientTracking) remember(key string) {
+	if t.enabled && !t.bcast {
+		t.keys[key] = true
+	}
+}
+
+func appendPush(b []byte, key string) []byte {
+	b = append(b, ">2\r\n"...)
+	b = redcon.AppendBulkString(b, "invalidate")
+	b = redcon.AppendArray(b, 1)
+	return redcon.AppendBulkString(b, key)
+}
+
+// push 通知经连接的writer写出 处理命令期间或尚未切换到独立循环时暂存 随下一次回复写出
+func (c *respClient) push(key string) error {
+	c.Lock()
+	defer c.Unlock()
+
+	if !c.tracking.wants(key) {
+		return nil
+	}
+
+	if c.tracking.busy || c.dconn == nil {
+		c.tracking.pending = append(c.tracking.pending, key)
+		return nil
+	}
+
+	nc := c.dconn.NetConn()
+	if err := nc.SetWriteDeadline(time.Now().Add(trackingWriteTimeout)); err != nil {
+		return err
+	}
+	defer nc.SetWriteDeadline(time.Time{})
+
+	c.dconn.WriteRaw(appendPush(nil, key))
+	return c.dconn.Flush()
+}
+
+// flush 写出回复及其后暂存的通知
+func (c *respClient) flush() error {
+	c.Lock()
+	defer c.Unlock()
+
+	for _, key := range c.tracking.pending {
+		c.dconn.WriteRaw(appendPush(nil, key))
+	}
+	c.tracking.pending = nil
+
+	return c.dconn.Flush()
+}
+
+// detach 开启CLIENT TRACKING后连接脱离redcon 由serveDetached读取命令 回复与通知只经同一writer写出
+func (c *respClient) detach(conn redcon.Conn) redcon.DetachedConn {
+	c.Lock()
+	defer c.Unlock()
+
+	if c.dconn != nil || !c.tracking.enabled {
+		return nil
+	}
+
+	c.dconn = conn.Detach()
+	return c.dconn
+}
+
+// beginCommand 命令处理开始 期间的通知暂存
+func (c *respClient) beginCommand() {
+	c.Lock()
+	c.tracking.busy = true
+	c.Unlock()
+}
+
+// endCommand 命令处理结束 暂存的通知在回复之后写出 NOLOOP时丢弃本连接自身引起的通知
+func (c *respClient) endCommand() {
+	c.Lock()
+	if c.tracking.noloop {
+		c.tracking.pending = nil
+	}
+	c.tracking.busy = false
+	c.Unlock()
+}
+
+// setTracking CLIENT TRACKING ON|OFF [BCAST] [PREFIX p ...] [NOLOOP]
+func (c *respClient) setTracking(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("ERR wrong number of arguments for 'client|tracking' command")
+	}
+
+	t := clientTracking{keys: make(map[string]bool)}
+	switch args[0] {
+	case "on":
+		t.enabled = true
+	case "off":
+	default:
+		return fmt.Errorf("ERR syntax error")
+	}
+
+	for i := 1; i < len(args); i++ {
+		switch args[i] {
+		case "bcast":
+			t.bcast = true
+		case "noloop":
+			t.noloop = true
+		case "prefix":
+			if i+1 >= len(args) {
+				return fmt.Errorf("ERR syntax error")
+			}
+			i++
+			t.prefixes = append(t.prefixes, args[i])
+		case "redirect", "optin", "optout":
+			return fmt.Errorf("ERR CLIENT TRACKING option '%s' is not supported", args[i])
+		default:
+			return fmt.Errorf("ERR syntax error")
+		}
+	}
+
+	if len(t.prefixes) > 0 && !t.bcast {
+		return fmt.Errorf("ERR PREFIX option requires BCAST mode to be enabled")
+	}
+
+	c.Lock()
+	defer c.Unlock()
+
+	if t.enabled && c.proto < 3 {
+		return fmt.Errorf("ERR CLIENT TRACKING requires RESP3, switch with HELLO 3")
+	}
+
+	t.busy = c.tracking.busy
+	c.tracking = t
+
+	return nil
+}
+
+func (c *respClient) trackingInfo() []interface{} {
+	c.Lock()
+	defer c.Unlock()
+
+	flags := []interface{}{"off"}
+	if c.tracking.enabled {
+		flags = []interface{}{"on"}
+		if c.tracking.bcast {
+			flags = append(flags, "bcast")
+		}
+		if c.tracking.noloop {
+			flags = append(flags, "noloop")
+		}
+	}
+
+	prefixes := make([]interface{}, 0, len(c.tracking.prefixes))
+	for _, prefix := range c.tracking.prefixes {
+		prefixes = append(prefixes, prefix)
+	}
+
+	return []interface{}{
+		"flags", flags,
+		"redirect", redcon.SimpleInt(-1),
+		"prefixes", prefixes,
+	}
+}
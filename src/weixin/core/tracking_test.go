@@ -0,0 +1,208 @@
+package core
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// respConn 原始RESP3连接 按到达顺序读取回复及推送
+type respConn struct {
+	net.Conn
+	rd *bufio.Reader
+}
+
+func dialResp(t *testing.T) *respConn {
+	t.Helper()
+
+	nc, err := net.Dial("tcp", respAddr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { nc.Close() })
+
+	return &respConn{Conn: nc, rd: bufio.NewReader(nc)}
+}
+
+// send 多条命令一次写入 模拟pipeline
+func (c *respConn) send(t *testing.T, cmds ...string) {
+	t.Helper()
+
+	var sb strings.Builder
+	for _, cmd := range cmds {
+		args := strings.Fields(cmd)
+		sb.WriteString(fmt.Sprintf("*%d\r\n", len(args)))
+		for _, arg := range args {
+			sb.WriteString(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))
+		}
+	}
+	if _, err := c.Write([]byte(sb.String())); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// read 读取一条消息 推送以">"开头 聚合类型展开为空格分隔
+func (c *respConn) read(t *testing.T) string {
+	t.Helper()
+
+	c.SetReadDeadline(time.Now().Add(2 * time.Second))
+	line, err := c.rd.ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+
+	switch line[0] {
+	case '$':
+		n, _ := strconv.Atoi(line[1:])
+		if n < 0 {
+			return "(nil)"
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(c.rd, buf); err != nil {
+			t.Fatal(err)
+		}
+		return string(buf[:n])
+	case '*', '>', '%':
+		n, _ := strconv.Atoi(line[1:])
+		if line[0] == '%' {
+			n *= 2
+		}
+		items := make([]string, 0, n)
+		for i := 0; i < n; i++ {
+			items = append(items, c.read(t))
+		}
+		prefix := ""
+		if line[0] == '>' {
+			prefix = ">"
+		}
+		return prefix + "[" + strings.Join(items, " ") + "]"
+	}
+
+	return line[1:]
+}
+
+func (c *respConn) expect(t *testing.T, want string) {
+	t.Helper()
+
+	if got := c.read(t); got != want {
+		t.Fatalf("read %q, want %q", got, want)
+	}
+}
+
+func trackingConn(t *testing.T, args string) *respConn {
+	t.Helper()
+
+	c := dialResp(t)
+	c.send(t, "HELLO 3")
+	if hello := c.read(t); !strings.Contains(hello, "proto 3") {
+		t.Fatalf("hello = %s", hello)
+	}
+	c.send(t, "CLIENT TRACKING "+args)
+	c.expect(t, "OK")
+
+	return c
+}
+
+func TestTrackingRequiresResp3(t *testing.T) {
+	setup(t)
+
+	c := dialResp(t)
+	c.send(t, "CLIENT TRACKING on")
+	c.expect(t, "ERR CLIENT TRACKING requires RESP3, switch with HELLO 3")
+
+	c.send(t, "HELLO 3", "CLIENT TRACKING on", "CLIENT TRACKINGINFO")
+	c.read(t)
+	c.expect(t, "OK")
+	c.expect(t, "[flags [on] redirect -1 prefixes []]")
+}
+
+// 本连接强制刷新引起的通知在回复之后到达
+func TestTrackingReplyBeforePush(t *testing.T) {
+	rc := setup(t)
+	do(t, rc, "token", "gzh")
+
+	c := trackingConn(t, "on")
+	c.send(t, "GET token:gzh")
+	old := c.read(t)
+
+	c.send(t, "TOKEN gzh 1")
+	token := c.read(t)
+	if token == old || token != fake.CurrentToken(testAppId) {
+		t.Fatalf("forced token = %s, old %s", token, old)
+	}
+	c.expect(t, ">[invalidate [token:gzh]]")
+
+	c.send(t, "PING")
+	c.expect(t, "PONG")
+}
+
+// 空闲时其他连接引起的通知立即推送 推送后不再跟踪该键
+func TestTrackingPushIdle(t *testing.T) {
+	rc := setup(t)
+	do(t, rc, "token", "gzh")
+
+	c := trackingConn(t, "on")
+	c.send(t, "GET token:gzh")
+	c.read(t)
+
+	do(t, rc, "token", "gzh", "1")
+	c.expect(t, ">[invalidate [token:gzh]]")
+
+	do(t, rc, "token", "gzh", "1")
+	c.send(t, "PING")
+	c.expect(t, "PONG")
+}
+
+func TestTrackingBcastNoloop(t *testing.T) {
+	rc := setup(t)
+
+	c := trackingConn(t, "on bcast prefix ticket: noloop")
+
+	//NOLOOP 本连接引起的通知丢弃
+	c.send(t, "TICKET gzh 1", "PING")
+	c.read(t)
+	c.expect(t, "PONG")
+
+	do(t, rc, "ticket", "gzh", "1")
+	c.expect(t, ">[invalidate [ticket:gzh]]")
+}
+
+// 未知命令的错误回复与推送同样不会交错
+func TestTrackingUnknownCommand(t *testing.T) {
+	rc := setup(t)
+	do(t, rc, "token", "gzh")
+
+	c := trackingConn(t, "on bcast prefix token:")
+
+	const n = 20
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			rc.Do(context.Background(), "token", "gzh", "1")
+		}
+	}()
+	for i := 0; i < n; i++ {
+		c.send(t, "NOSUCH")
+	}
+	<-done
+
+	errs, pushes := 0, 0
+	for errs < n || pushes < n {
+		switch msg := c.read(t); msg {
+		case "ERR unknown command 'nosuch'":
+			errs++
+		case ">[invalidate [token:gzh]]":
+			pushes++
+		default:
+			t.Fatalf("unexpected message %q", msg)
+		}
+	}
+}
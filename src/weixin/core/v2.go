@@ -0,0 +1,112 @@
+package core
+
+import (
+	_ "embed"
+	"errors"
+	"github.com/gin-gonic/gin"
+	"net/http"
+	"time"
+)
+
+//go:embed openapi.yaml
+var openapiSpec []byte
+
+// v2Value /v2接口成功时data字段
+type v2Value struct {
+	Section     string `json:"section"`
+	Kind        string `json:"kind"`
+	Type        string `json:"type,omitempty"`
+	Value       string `json:"value"`
+	ExpireAt    int64  `json:"expireAt"`
+	ExpiresIn   int64  `json:"expiresIn"`
+	RefreshedAt int64  `json:"refreshedAt"`
+	Source      string `json:"source"`
+}
+
+// v2Error /v2接口失败时error字段 errcode及errmsg为微信接口返回值
+type v2Error struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	ErrCode int    `json:"errcode,omitempty"`
+	ErrMsg  string `json:"errmsg,omitempty"`
+}
+
+var v2ErrorStatus = map[string]int{
+	errNotFound:       http.StatusNotFound,
+	errInvalidType:    http.StatusBadRequest,
+	errInvalidConfig:  http.StatusInternalServerError,
+	errUpstreamFail:   http.StatusBadGateway,
+	errUpstreamReject: http.StatusBadGateway,
+	errClusterTimeout: http.StatusGatewayTimeout,
+	errCircuitOpen:    http.StatusServiceUnavailable,
+}
+
+func writeV2Error(c *gin.Context, err error) {
+	ve := &v2Error{Code: "internal", Message: err.Error()}
+	code := http.StatusInternalServerError
+
+	var we *WError
+	if errors.As(err, &we) {
+		ve.Code = we.Code
+		ve.ErrCode = we.ErrCode
+		ve.ErrMsg = we.ErrMsg
+		if status, ok := v2ErrorStatus[we.Code]; ok {
+			code = status
+		}
+	}
+
+	c.JSON(code, gin.H{"error": ve})
+}
+
+func writeV2Value(c *gin.Context, value *v2Value, wxValue *WValues) {
+	value.Value = wxValue.value
+	value.ExpireAt = wxValue.expireAt.Unix()
+	value.ExpiresIn = int64(time.Until(wxValue.expireAt).Seconds())
+	value.RefreshedAt = unixOrZero(wxValue.refreshAt)
+	value.Source = wxValue.source
+
+	c.JSON(http.StatusOK, gin.H{"data": value})
+}
+
+func v2Token(cacheFirst bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+
+		wxValue, err := GetToken(name, cacheFirst)
+		httpRecord(c).track(kindToken, wxValue, cacheFirst, err)
+		if err != nil {
+			writeV2Error(c, err)
+			return
+		}
+
+		writeV2Value(c, &v2Value{Section: name, Kind: kindToken}, wxValue)
+	}
+}
+
+func v2Ticket(cacheFirst bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		name := c.Param("name")
+		ticketType := c.DefaultQuery("type", ticketJsapi)
+
+		wxValue, err := GetTypedTicket(name, ticketType, cacheFirst)
+		httpRecord(c).track(kindTicket, wxValue, cacheFirst, err)
+		if err != nil {
+			writeV2Error(c, err)
+			return
+		}
+
+		writeV2Value(c, &v2Value{Section: name, Kind: kindTicket, Type: ticketType}, wxValue)
+	}
+}
+
+// registerV2 GET读取(优先缓存) POST强制刷新 失败时返回对应http状态码及结构化错误
+func registerV2(router *gin.Engine) {
+	v2 := router.Group("/v2")
+	v2.GET("/token/:name", v2Token(true))
+	v2.POST("/token/:name", v2Token(false))
+	v2.GET("/ticket/:name", v2Ticket(true))
+	v2.POST("/ticket/:name", v2Ticket(false))
+	v2.GET("/openapi.yaml", func(c *gin.Context) {
+		c.Data(http.StatusOK, "application/yaml", openapiSpec)
+	})
+}
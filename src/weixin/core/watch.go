@@ -0,0 +1,65 @@
+package core
+
+import (
+	"sync"
+	"weixin/common"
+)
+
+// refreshEvent token或ticket被替换后的新值
+type refreshEvent struct {
+	kind       string
+	section    string
+	ticketType string
+	value      *WValues
+}
+
+// refreshWatchers WatchRefresh订阅者 每个订阅者一个带缓冲的channel
+var refreshWatchers = struct {
+	sync.Mutex
+	seq      int
+	watchers map[int]chan *refreshEvent
+}{watchers: make(map[int]chan *refreshEvent)}
+
+// valueChanged token或ticket被替换或清除时通知CLIENT TRACKING客户端及WatchRefresh订阅者 value为nil表示清除
+func valueChanged(kind, section, ticketType string, value *WValues) {
+	invalidateValue(kind, section, ticketType)
+
+	if value == nil {
+		return
+	}
+
+	if kind == kindTicket && len(ticketType) == 0 {
+		ticketType = ticketJsapi
+	}
+
+	ev := &refreshEvent{kind: kind, section: section, ticketType: ticketType, value: value}
+
+	refreshWatchers.Lock()
+	defer refreshWatchers.Unlock()
+
+	for id, ch := range refreshWatchers.watchers {
+		select {
+		case ch <- ev:
+		default:
+			common.Logger.Warn("refresh watcher queue full", "watcher", id, "section", section, "kind", kind)
+		}
+	}
+}
+
+func watchRefresh() (int, <-chan *refreshEvent) {
+	refreshWatchers.Lock()
+	defer refreshWatchers.Unlock()
+
+	refreshWatchers.seq++
+	ch := make(chan *refreshEvent, 64)
+	refreshWatchers.watchers[refreshWatchers.seq] = ch
+
+	return refreshWatchers.seq, ch
+}
+
+func unwatchRefresh(id int) {
+	refreshWatchers.Lock()
+	defer refreshWatchers.Unlock()
+
+	delete(refreshWatchers.watchers, id)
+}
@@ -1,21 +1,56 @@
 package core
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
-	"github.com/karlseguin/jsonwriter"
-	"github.com/tidwall/gjson"
-	"os"
+	"github.com/prometheus/client_golang/prometheus"
+	"io"
+	"net/http"
+	"sort"
 	"sync"
+	"sync/atomic"
 	"time"
 	"weixin/common"
 )
 
+const (
+	sourceCache    = "cache"
+	sourceUpstream = "upstream"
+	sourceShared   = "shared"
+)
+
 type WValues struct {
-	expireAt time.Time
-	value    string
+	expireAt  time.Time
+	refreshAt time.Time
+	value     string
+	source    string
+}
+
+func (v *WValues) Value() string {
+	return v.value
+}
+
+func (v *WValues) ExpireAt() time.Time {
+	return v.expireAt
+}
+
+// RefreshAt 最近一次请求微信接口的时间 未知时为零值
+func (v *WValues) RefreshAt() time.Time {
+	return v.refreshAt
+}
+
+// Source cache,upstream或shared
+func (v *WValues) Source() string {
+	return v.source
+}
+
+// cached 返回标记为缓存命中的副本
+func (v *WValues) cached() *WValues {
+	c := *v
+	c.source = sourceCache
+	return &c
 }
 
 type WResponse struct {
@@ -27,85 +62,439 @@ type WResponse struct {
 }
 
 type WItem struct {
+	Name          string
 	AppId         string
 	AppSecret     string
 	IsEnterprise  bool
 	UseCacheFirst bool
+	TicketType    string
+	Mock          *MockOptions
+	Egress        Egress
+}
+
+const (
+	ticketJsapi  = "jsapi"
+	ticketWxCard = "wx_card"
+)
+
+// ticketKey jsapi ticket以appId为key 其他类型追加类型后缀
+func ticketKey(appId, ticketType string) string {
+	if len(ticketType) == 0 || ticketType == ticketJsapi {
+		return appId
+	}
+	return appId + ":" + ticketType
+}
+
+const (
+	errNotFound        = "not_found"
+	errInvalidConfig   = "invalid_config"
+	errInvalidType     = "invalid_type"
+	errInvalidArgument = "invalid_argument"
+	errUpstreamFail    = "upstream_unreachable"
+	errUpstreamReject  = "upstream_error"
+	errClusterTimeout  = "cluster_timeout"
+	errCircuitOpen     = "upstream_circuit_open"
+)
+
+// WError 获取token或ticket失败的原因 ErrCode及ErrMsg为微信接口返回值
+type WError struct {
+	Code    string
+	ErrCode int
+	ErrMsg  string
+	message string
 }
 
-type Weixin struct {
+func (e *WError) Error() string {
+	return e.message
+}
+
+func newWError(code, message string) *WError {
+	return &WError{Code: code, message: message}
+}
+
+func upstreamError(wRes *WResponse, message string) *WError {
+	return &WError{Code: errUpstreamReject, ErrCode: wRes.ErrorCode, ErrMsg: wRes.ErrorMsg, message: message}
+}
+
+// WStatus section最近的刷新情况
+type WStatus struct {
+	RefreshAt    time.Time
+	RefreshCount int
+	LastError    string
+	LastErrorAt  time.Time
+}
+
+// Account 公众号或企业微信配置 AppId或AppSecret为空时视为未配置 Mock非nil时不需要AppSecret
+type Account struct {
+	Name         string
+	AppId        string
+	AppSecret    string
+	IsEnterprise bool
+	Mock         *MockOptions
+	// Egress 为零值时直连
+	Egress Egress
+	// ConfigError 不为空时该section的请求均返回配置错误
+	ConfigError string
+}
+
+// ManagerConfig Manager的全部依赖 不读取全局配置
+type ManagerConfig struct {
+	Accounts []Account
+	// Storage 为nil时根据StorageConfig创建 均为nil时不持久化
+	Storage Storage
+	// StorageConfig 由Manager创建的存储在Close时关闭
+	StorageConfig *StorageConfig
+	// Cluster 为nil时不与其他实例共享
+	Cluster *Cluster
+	// HTTPClient 请求微信接口 为nil时使用httplib默认设置
+	HTTPClient *http.Client
+	// Retry 请求微信接口失败后的重试策略 零值时不重试
+	Retry RetryPolicy
+	// Breaker 熔断策略 零值时不熔断
+	Breaker BreakerPolicy
+	// Clock 为nil时使用time.Now
+	Clock func() time.Time
+	// OnChange token或ticket被替换或清除时调用 value为nil表示清除
+	OnChange func(kind, section, ticketType string, value *WValues)
+	// Registerer 不为nil时注册缓存剩余有效期指标 Close时注销
+	Registerer prometheus.Registerer
+}
+
+// Manager 内嵌锁只保护各map 请求微信接口时持有对应appId的刷新锁 不同公众号可并发刷新
+type Manager struct {
 	sync.Mutex
-	tokens  map[string]*WValues
-	tickets map[string]*WValues
+	accounts   map[string]Account
+	names      []string
+	tokens     map[string]*WValues
+	tickets    map[string]*WValues
+	status     map[string]*WStatus
+	refreshing map[string]*sync.Mutex
+	saving     sync.Mutex
+	storage    Storage
+	ownStorage bool
+	cluster    *Cluster
+	httpClient *http.Client
+	retry      RetryPolicy
+	breakers   *breakers
+	transports map[Egress]*http.Transport
+	clock      func() time.Time
+	onChange   func(kind, section, ticketType string, value *WValues)
+	mock       *mocker
+	registerer prometheus.Registerer
+	collector  *expireCollector
+	ctx        context.Context
+	cancel     context.CancelFunc
+}
+
+// wx 各服务共用的Manager 由Run根据配置创建 各服务通过manager读取
+var wx atomic.Pointer[Manager]
+
+func manager() *Manager {
+	return wx.Load()
 }
 
-var wx *Weixin
+func NewManager(cfg ManagerConfig) (*Manager, error) {
+	m := &Manager{
+		accounts:   make(map[string]Account, len(cfg.Accounts)),
+		names:      make([]string, 0, len(cfg.Accounts)),
+		tokens:     make(map[string]*WValues, 0),
+		tickets:    make(map[string]*WValues, 0),
+		status:     make(map[string]*WStatus, 0),
+		refreshing: make(map[string]*sync.Mutex, 0),
+		storage:    cfg.Storage,
+		cluster:    cfg.Cluster,
+		httpClient: cfg.HTTPClient,
+		retry:      cfg.Retry,
+		breakers:   newBreakers(cfg.Breaker),
+		transports: make(map[Egress]*http.Transport),
+		clock:      cfg.Clock,
+		onChange:   cfg.OnChange,
+		mock:       newMocker(),
+	}
+	m.ctx, m.cancel = context.WithCancel(context.Background())
+	if m.clock == nil {
+		m.clock = time.Now
+	}
 
-func init() {
-	wx = &Weixin{
-		tokens:  make(map[string]*WValues, 0),
-		tickets: make(map[string]*WValues, 0),
+	for _, account := range cfg.Accounts {
+		if len(account.Name) == 0 {
+			return nil, newWError(errInvalidConfig, "account name is empty")
+		}
+		if _, ok := m.accounts[account.Name]; ok {
+			return nil, newWError(errInvalidConfig, fmt.Sprintf("duplicate account %s", account.Name))
+		}
+		if err := account.Egress.Validate(); err != nil {
+			return nil, newWError(errInvalidConfig, fmt.Sprintf("invalid egress of %s %v", account.Name, err))
+		}
+		m.accounts[account.Name] = account
+		m.names = append(m.names, account.Name)
 	}
+	sort.Strings(m.names)
+
+	if m.storage == nil && cfg.StorageConfig != nil {
+		storage, err := NewStorage(*cfg.StorageConfig)
+		if err != nil {
+			return nil, err
+		}
+		m.storage, m.ownStorage = storage, storage != nil
+	}
+
+	if cfg.Registerer != nil {
+		collector := &expireCollector{m: m}
+		if err := cfg.Registerer.Register(collector); err != nil {
+			if m.ownStorage {
+				m.storage.Close()
+			}
+			return nil, err
+		}
+		m.registerer, m.collector = cfg.Registerer, collector
+	}
+
+	return m, nil
 }
 
-func SaveAll() {
-	wx.Lock()
-	defer wx.Unlock()
+func (m *Manager) now() time.Time {
+	return m.clock()
+}
 
-	wx.save()
+// Accounts 返回已配置的section名称
+func (m *Manager) Accounts() []string {
+	return m.names
 }
 
-func GetToken(name string, cacheFirst bool) (*WValues, error) {
-	appId := common.Config.IniCfg.Section(name).Key("app_id").String()
-	appSecret := common.Config.IniCfg.Section(name).Key("app_secret").String()
+func (m *Manager) Account(name string) (Account, bool) {
+	account, ok := m.accounts[name]
+	return account, ok
+}
+
+func (m *Manager) IsAccount(name string) bool {
+	_, ok := m.accounts[name]
+	return ok
+}
 
-	if len(appId) == 0 || len(appSecret) == 0 {
-		return nil, fmt.Errorf("ERR not found match gzh config with %v", name)
+// AppId 返回section对应的app_id 未配置时为空
+func (m *Manager) AppId(name string) string {
+	return m.accounts[name].AppId
+}
+
+// changed 通知token或ticket被替换或清除
+func (m *Manager) changed(kind, section, ticketType string, value *WValues) {
+	if m.onChange != nil {
+		m.onChange(kind, section, ticketType, value)
 	}
+}
 
-	isEnterprise, err := common.Config.IniCfg.Section(name).Key("is_enterprise").Bool()
-	if err != nil {
-		return nil, err
+// Close 取消进行中的微信接口请求 之后的刷新均失败 缓存中的值仍可获取
+func (m *Manager) Close() {
+	m.cancel()
+
+	if m.registerer != nil {
+		m.registerer.Unregister(m.collector)
+	}
+	if m.ownStorage {
+		m.storage.Close()
 	}
 
-	wi := &WItem{AppId: appId, AppSecret: appSecret, IsEnterprise: isEnterprise, UseCacheFirst: cacheFirst}
+	if m.httpClient == nil {
+		CloseIdleConnections()
+	} else {
+		m.httpClient.CloseIdleConnections()
+	}
 
-	return wx.getToken(wi, true)
+	m.Lock()
+	defer m.Unlock()
+	for _, t := range m.transports {
+		t.CloseIdleConnections()
+	}
 }
 
-func GetTicket(name string, cacheFirst bool) (*WValues, error) {
-	isEnterprise, err := common.Config.IniCfg.Section(name).Key("is_enterprise").Bool()
+// request 请求微信接口 ctx取消时中止 配置HTTPClient时忽略egress
+func (m *Manager) request(ctx context.Context, egress Egress, url string) ([]byte, error) {
+	if m.httpClient == nil {
+		req := Get(url).SetContext(ctx)
+		if !egress.isZero() {
+			t, err := m.transport(egress)
+			if err != nil {
+				return nil, err
+			}
+			req.SetTransport(t)
+		}
+		return req.Bytes()
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, url, nil)
 	if err != nil {
 		return nil, err
 	}
 
-	appId := common.Config.IniCfg.Section(name).Key("app_id").String()
-	appSecret := common.Config.IniCfg.Section(name).Key("app_secret").String()
+	res, err := m.httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	return io.ReadAll(res.Body)
+}
+
+// upstream mode=mock的section由mocker生成响应 否则请求微信接口
+func (m *Manager) upstream(ctx context.Context, wi *WItem, kind, url string) ([]byte, error) {
+	if wi.Mock != nil {
+		return m.mock.respond(wi, kind, url)
+	}
+	return m.request(ctx, wi.Egress, url)
+}
+
+func SaveAll() {
+	manager().Save()
+}
+
+// refreshLock 返回appId的刷新锁 同一公众号的token和ticket串行刷新
+func (m *Manager) refreshLock(appId string) *sync.Mutex {
+	m.Lock()
+	defer m.Unlock()
 
-	if len(appId) == 0 || len(appSecret) == 0 {
-		return nil, fmt.Errorf("ERR not found match gzh config with %v", name)
+	l, ok := m.refreshing[appId]
+	if !ok {
+		l = &sync.Mutex{}
+		m.refreshing[appId] = l
 	}
 
-	wi := &WItem{
-		AppId:         appId,
-		AppSecret:     appSecret,
-		IsEnterprise:  isEnterprise,
+	return l
+}
+
+func (m *Manager) valuesOf(kind string) map[string]*WValues {
+	if kind == kindTicket {
+		return m.tickets
+	}
+	return m.tokens
+}
+
+// current 返回缓存中的值 可能已过期
+func (m *Manager) current(kind, key string) *WValues {
+	m.Lock()
+	defer m.Unlock()
+
+	return m.valuesOf(kind)[key]
+}
+
+func (m *Manager) store(kind, key string, v *WValues) {
+	m.Lock()
+	defer m.Unlock()
+
+	m.valuesOf(kind)[key] = v
+}
+
+func (m *Manager) remove(kind, key string) bool {
+	m.Lock()
+	defer m.Unlock()
+
+	_, ok := m.valuesOf(kind)[key]
+	delete(m.valuesOf(kind), key)
+
+	return ok
+}
+
+// item 返回section的请求参数 未配置时返回not_found
+func (m *Manager) item(name, kind string, cacheFirst bool) (*WItem, error) {
+	account, ok := m.accounts[name]
+	if !ok || len(account.AppId) == 0 || (len(account.AppSecret) == 0 && account.Mock == nil) {
+		observeCache(&WItem{Name: metricUnknown}, kind, "invalid")
+		return nil, newWError(errNotFound, fmt.Sprintf("ERR not found match gzh config with %v", name))
+	}
+	if len(account.ConfigError) > 0 {
+		observeCache(&WItem{Name: name}, kind, "invalid")
+		return nil, newWError(errInvalidConfig, account.ConfigError)
+	}
+
+	return &WItem{
+		Name:          name,
+		AppId:         account.AppId,
+		AppSecret:     account.AppSecret,
+		IsEnterprise:  account.IsEnterprise,
 		UseCacheFirst: cacheFirst,
+		Mock:          account.Mock,
+		Egress:        account.Egress,
+	}, nil
+}
+
+// Token 获取access_token cacheFirst为false时强制刷新
+func (m *Manager) Token(name string, cacheFirst bool) (*WValues, error) {
+	wi, err := m.item(name, kindToken, cacheFirst)
+	if err != nil {
+		return nil, err
 	}
 
-	return wx.getTicket(wi, true)
+	return m.getToken(m.ctx, wi, true)
 }
 
-func (w *Weixin) getToken(wi *WItem, autoLock bool) (*WValues, error) {
+// Ticket 获取指定类型的ticket 支持jsapi及wx_card(卡券)
+func (m *Manager) Ticket(name, ticketType string, cacheFirst bool) (*WValues, error) {
+	wi, err := m.item(name, kindTicket, cacheFirst)
+	if err != nil {
+		return nil, err
+	}
+	wi.TicketType = ticketType
+
+	switch {
+	case ticketType == ticketJsapi:
+	case ticketType == ticketWxCard && !wi.IsEnterprise:
+	default:
+		observeCache(wi, kindTicket, "invalid")
+		return nil, newWError(errInvalidType, fmt.Sprintf("ERR not support ticket type %v with %v", ticketType, name))
+	}
+
+	return m.getTicket(m.ctx, wi, true)
+}
+
+func GetToken(name string, cacheFirst bool) (*WValues, error) {
+	return manager().Token(name, cacheFirst)
+}
+
+func GetTicket(name string, cacheFirst bool) (*WValues, error) {
+	return manager().Ticket(name, ticketJsapi, cacheFirst)
+}
+
+// GetTypedTicket 获取指定类型的ticket 支持jsapi及wx_card(卡券)
+func GetTypedTicket(name, ticketType string, cacheFirst bool) (*WValues, error) {
+	return manager().Ticket(name, ticketType, cacheFirst)
+}
+
+// getToken autoLock为true时为一次获取的入口 之后的请求共用同一个deadline
+func (m *Manager) getToken(ctx context.Context, wi *WItem, autoLock bool) (*WValues, error) {
 	if autoLock {
-		w.Lock()
-		defer w.Unlock()
+		l := m.refreshLock(wi.AppId)
+		l.Lock()
+		defer l.Unlock()
 	}
 
 	if wi.UseCacheFirst {
-		if v, ok := w.tokens[wi.AppId]; ok && v.expireAt.After(time.Now()) {
+		if v := m.cachedValue(wi, kindToken, wi.AppId); v != nil {
+			return v, nil
+		}
+	}
+
+	if m.cluster != nil {
+		v, err := m.cluster.resolve(kindToken, wi.AppId, m.current(kindToken, wi.AppId), wi.UseCacheFirst)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			observeCache(wi, kindToken, "shared")
+			v.source = sourceShared
+			m.store(kindToken, wi.AppId, v)
+			m.changed(kindToken, wi.Name, "", v)
 			return v, nil
 		}
+		//本实例获取了租约 刷新完成后释放
+		defer m.cluster.release(wi.AppId)
+	}
+
+	observeCache(wi, kindToken, "miss")
+
+	if autoLock {
+		var cancel context.CancelFunc
+		ctx, cancel = m.withDeadline(ctx)
+		defer cancel()
 	}
 
 	/**
@@ -122,49 +511,123 @@ func (w *Weixin) getToken(wi *WItem, autoLock bool) (*WValues, error) {
 		tokenApiUrl = fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=%s&secret=%s", wi.AppId, wi.AppSecret)
 	}
 
-	res, err := Get(tokenApiUrl).Bytes()
+	startAt := time.Now()
+	res, err := m.call(ctx, wi, kindToken, tokenApiUrl)
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		return m.shortCircuit(wi, kindToken, wi.AppId, open.wait)
+	}
+	observeUpstream(wi, kindToken, startAt)
 	if err != nil {
-		delete(wx.tickets, wi.AppId)
-		common.Logger.Printf("request weixin token api fail appId=%s,api=%s,%v", wi.AppId, tokenApiUrl, err)
-		return nil, errors.New("request weixin token api fail")
+		m.failed(wi, kindToken, -1, "request weixin token api fail")
+		m.dropTickets(wi)
+		common.Logger.Warn("request weixin token api fail", "section", wi.Name, "appId", wi.AppId, "api", tokenApiUrl, "err", err)
+		return nil, newWError(errUpstreamFail, "request weixin token api fail")
 	}
 
 	var wRes WResponse
 
 	err = json.Unmarshal(res, &wRes)
 	if err != nil || len(wRes.AccessToken) == 0 {
-		delete(wx.tickets, wi.AppId)
-		common.Logger.Printf("parse weixin token api response fail appId=%s,api=%s,response=%s", wi.AppId, tokenApiUrl, string(res))
-		return nil, errors.New("parse weixin token api response fail")
+		m.failed(wi, kindToken, wRes.ErrorCode, wRes.ErrorMsg)
+		m.dropTickets(wi)
+		common.Logger.Warn("parse weixin token api response fail", "section", wi.Name, "appId", wi.AppId, "api", tokenApiUrl, "response", string(res))
+		return nil, upstreamError(&wRes, "parse weixin token api response fail")
+	}
+
+	common.RegisterSecret(wRes.AccessToken)
+	token := &WValues{
+		expireAt:  m.now().Add(time.Second * time.Duration(wRes.ExpiresIn-10)),
+		refreshAt: m.now(),
+		value:     wRes.AccessToken,
+		source:    sourceUpstream,
 	}
+	m.store(kindToken, wi.AppId, token)
 
-	w.tokens[wi.AppId] = &WValues{
-		expireAt: time.Now().Add(time.Second * time.Duration(wRes.ExpiresIn-10)),
-		value:    wRes.AccessToken,
+	if m.cluster != nil {
+		m.cluster.publish(kindToken, wi.AppId, token)
 	}
 
-	common.Logger.Printf("refresh weixin token success appId=%s,token=%s,expireAt=%s", wi.AppId, wRes.AccessToken, w.tokens[wi.AppId].expireAt.Format("2006-01-02 15:04:05"))
+	m.changed(kindToken, wi.Name, "", token)
+
+	m.refreshed(wi, kindToken)
+
+	common.Logger.Info("refresh weixin token success", "section", wi.Name, "appId", wi.AppId, "token", common.Secret(wRes.AccessToken), "expireAt", token.expireAt.Format("2006-01-02 15:04:05"))
 
 	if autoLock {
-		w.save()
+		m.Save()
 	}
 
-	return w.tokens[wi.AppId], nil
+	return token, nil
 }
 
-func (w *Weixin) getTicket(wi *WItem, autoLock bool) (*WValues, error) {
+// getTicket 获取token及ticket的请求共用同一个deadline
+// cachedValue 返回可直接使用的缓存值 没有时返回nil
+// 集群模式下以共享存储为准 其他实例强制刷新后本地缓存即已过时 共享存储不可用时使用本地缓存
+func (m *Manager) cachedValue(wi *WItem, kind, key string) *WValues {
+	local := m.lookup(kind, key)
+
+	if m.cluster != nil {
+		shared, err := m.cluster.lookup(kind, key)
+		if err != nil {
+			common.Logger.Warn("cluster get fail", "kind", kind, "appId", key, "err", err)
+		} else if shared != nil && (local == nil || shared.value != local.value) {
+			observeCache(wi, kind, "shared")
+			shared.source = sourceShared
+			m.store(kind, key, shared)
+			m.changed(kind, wi.Name, wi.TicketType, shared)
+			return shared
+		}
+	}
+
+	if local == nil {
+		return nil
+	}
+
+	observeCache(wi, kind, "hit")
+	return local.cached()
+}
+
+func (m *Manager) getTicket(ctx context.Context, wi *WItem, autoLock bool) (*WValues, error) {
 	if autoLock {
-		w.Lock()
-		defer w.Unlock()
+		l := m.refreshLock(wi.AppId)
+		l.Lock()
+		defer l.Unlock()
 	}
 
+	key := ticketKey(wi.AppId, wi.TicketType)
+
 	if wi.UseCacheFirst {
-		if v, ok := w.tickets[wi.AppId]; ok && v.expireAt.After(time.Now()) {
+		if v := m.cachedValue(wi, kindTicket, key); v != nil {
+			return v, nil
+		}
+	}
+
+	if m.cluster != nil {
+		v, err := m.cluster.resolve(kindTicket, key, m.current(kindTicket, key), wi.UseCacheFirst)
+		if err != nil {
+			return nil, err
+		}
+		if v != nil {
+			observeCache(wi, kindTicket, "shared")
+			v.source = sourceShared
+			m.store(kindTicket, key, v)
+			m.changed(kindTicket, wi.Name, wi.TicketType, v)
 			return v, nil
 		}
+		//本实例获取了租约 刷新完成后释放
+		defer m.cluster.release(wi.AppId)
 	}
 
-	wxValue, err := w.getToken(wi, false)
+	observeCache(wi, kindTicket, "miss")
+
+	if autoLock {
+		var cancel context.CancelFunc
+		ctx, cancel = m.withDeadline(ctx)
+		defer cancel()
+	}
+
+	wxValue, err := m.getToken(ctx, wi, false)
 	if err != nil {
 		return nil, err
 	}
@@ -178,134 +641,266 @@ func (w *Weixin) getTicket(wi *WItem, autoLock bool) (*WValues, error) {
 	if wi.IsEnterprise {
 		ticketApiUrl = fmt.Sprintf("https://qyapi.weixin.qq.com/cgi-bin/get_jsapi_ticket?access_token=%s", wxValue.value)
 	} else {
-		ticketApiUrl = fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/ticket/getticket?access_token=%s&type=jsapi", wxValue.value)
+		ticketApiUrl = fmt.Sprintf("https://api.weixin.qq.com/cgi-bin/ticket/getticket?access_token=%s&type=%s", wxValue.value, ticketType(wi))
 	}
 
-	res, err := Get(ticketApiUrl).Bytes()
+	startAt := time.Now()
+	res, err := m.call(ctx, wi, kindTicket, ticketApiUrl)
+	var open *breakerOpenError
+	if errors.As(err, &open) {
+		return m.shortCircuit(wi, kindTicket, key, open.wait)
+	}
+	observeUpstream(wi, kindTicket, startAt)
 	if err != nil {
-		common.Logger.Printf("request weixin ticket api fail appId=%s,api=%s,%v", wi.AppId, ticketApiUrl, err)
-		return nil, errors.New("request weixin ticket api fail")
+		m.failed(wi, kindTicket, -1, "request weixin ticket api fail")
+		common.Logger.Warn("request weixin ticket api fail", "section", wi.Name, "appId", wi.AppId, "api", ticketApiUrl, "err", err)
+		return nil, newWError(errUpstreamFail, "request weixin ticket api fail")
 	}
 
 	var wRes WResponse
 
 	err = json.Unmarshal(res, &wRes)
 	if err != nil || len(wRes.Ticket) == 0 {
-		common.Logger.Printf("parse weixin ticket api response fail appId=%s,api=%s,response=%s", wi.AppId, ticketApiUrl, string(res))
+		m.failed(wi, kindTicket, wRes.ErrorCode, wRes.ErrorMsg)
+		common.Logger.Warn("parse weixin ticket api response fail", "section", wi.Name, "appId", wi.AppId, "api", ticketApiUrl, "response", string(res))
 		if wRes.ErrorCode == 40001 {
 			if wi.UseCacheFirst {
 				wi.UseCacheFirst = false
-				common.Logger.Printf("will retry getTicket with no cache & lock")
-				return w.getTicket(wi, false)
+				common.Logger.Info("will retry getTicket with no cache & lock", "section", wi.Name)
+				return m.getTicket(ctx, wi, false)
 			} else {
-				delete(w.tokens, wi.AppId)
+				m.remove(kindToken, wi.AppId)
+				m.changed(kindToken, wi.Name, "", nil)
 			}
 		}
-		return nil, errors.New("parse weixin ticket api response fail")
+		return nil, upstreamError(&wRes, "parse weixin ticket api response fail")
 	}
 
-	w.tickets[wi.AppId] = &WValues{
-		expireAt: time.Now().Add(time.Second * time.Duration(wRes.ExpiresIn-10)),
-		value:    wRes.Ticket,
+	common.RegisterSecret(wRes.Ticket)
+	ticket := &WValues{
+		expireAt:  m.now().Add(time.Second * time.Duration(wRes.ExpiresIn-10)),
+		refreshAt: m.now(),
+		value:     wRes.Ticket,
+		source:    sourceUpstream,
 	}
+	m.store(kindTicket, key, ticket)
 
-	common.Logger.Printf("refresh weixin ticket success appId=%s,ticket=%s,expireAt=%s", wi.AppId, wRes.Ticket, w.tokens[wi.AppId].expireAt.Format("2006-01-02 15:04:05"))
+	if m.cluster != nil {
+		m.cluster.publish(kindTicket, key, ticket)
+	}
 
-	w.save()
+	m.changed(kindTicket, wi.Name, wi.TicketType, ticket)
 
-	return w.tickets[wi.AppId], nil
+	m.refreshed(wi, kindTicket)
+
+	common.Logger.Info("refresh weixin ticket success", "section", wi.Name, "type", ticketType(wi), "appId", wi.AppId, "ticket", common.Secret(wRes.Ticket), "expireAt", ticket.expireAt.Format("2006-01-02 15:04:05"))
+
+	m.Save()
+
+	return ticket, nil
 }
 
-func (w *Weixin) LoadData() {
-	w.Lock()
-	defer w.Unlock()
+// dropTickets token获取失败时清除依赖该token的ticket
+func (m *Manager) dropTickets(wi *WItem) {
+	for _, t := range []string{ticketJsapi, ticketWxCard} {
+		if m.remove(kindTicket, ticketKey(wi.AppId, t)) {
+			m.changed(kindTicket, wi.Name, t, nil)
+		}
+	}
+}
 
-	if len(common.Config.DataFile) == 0 {
-		common.Logger.Print("not found data file")
-		return
+// ticketType 未指定时为jsapi
+func ticketType(wi *WItem) string {
+	if len(wi.TicketType) == 0 {
+		return ticketJsapi
 	}
+	return wi.TicketType
+}
 
-	jsonContent, err := os.ReadFile(common.Config.DataFile)
-	if err != nil {
-		common.Logger.Print(err)
-		return
+func statusKey(name, kind string) string {
+	return kind + ":" + name
+}
+
+// statusKind jsapi以外的ticket单独记录刷新情况
+func statusKind(wi *WItem, kind string) string {
+	if kind == kindTicket && ticketType(wi) != ticketJsapi {
+		return kind + ":" + wi.TicketType
 	}
+	return kind
+}
 
-	if !gjson.ValidBytes(jsonContent) {
-		common.Logger.Printf("read error json format data")
-		return
+func (m *Manager) refreshed(wi *WItem, kind string) {
+	m.Lock()
+	defer m.Unlock()
+
+	key := statusKey(wi.Name, statusKind(wi, kind))
+	status, ok := m.status[key]
+	if !ok {
+		status = &WStatus{}
+		m.status[key] = status
+	}
+
+	status.RefreshAt = m.now()
+	status.RefreshCount++
+}
+
+func (m *Manager) failed(wi *WItem, kind string, errCode int, errMsg string) {
+	observeUpstreamFailure(wi, kind, errCode)
+
+	m.Lock()
+	defer m.Unlock()
+
+	key := statusKey(wi.Name, statusKind(wi, kind))
+	status, ok := m.status[key]
+	if !ok {
+		status = &WStatus{}
+		m.status[key] = status
 	}
 
-	jsonResult := gjson.ParseBytes(jsonContent)
+	status.LastError = fmt.Sprintf("errcode=%d,errmsg=%s", errCode, errMsg)
+	status.LastErrorAt = m.now()
+}
+
+// statusOf 返回section的刷新情况副本
+func (m *Manager) statusOf(name, kind string) WStatus {
+	m.Lock()
+	defer m.Unlock()
+
+	if status, ok := m.status[statusKey(name, kind)]; ok {
+		return *status
+	}
+
+	return WStatus{}
+}
 
-	tokens := jsonResult.Get("tokens")
-	tokens.ForEach(func(key, value gjson.Result) bool {
-		expireAt := time.Unix(value.Get("expireAt").Int(), 0)
-		if expireAt.Before(time.Now()) {
-			return true
+// values 返回appId当前未过期的token和ticket
+func (m *Manager) values(appId string) map[string]*WValues {
+	m.Lock()
+	defer m.Unlock()
+
+	values := make(map[string]*WValues)
+	if v, ok := m.tokens[appId]; ok && v.expireAt.After(m.now()) {
+		values[kindToken] = v
+	}
+	if v, ok := m.tickets[appId]; ok && v.expireAt.After(m.now()) {
+		values[kindTicket] = v
+	}
+
+	return values
+}
+
+// lookup 返回缓存中未过期的值 不请求微信接口
+func (m *Manager) lookup(kind, key string) *WValues {
+	m.Lock()
+	defer m.Unlock()
+
+	if v, ok := m.valuesOf(kind)[key]; ok && v.expireAt.After(m.now()) {
+		c := *v
+		return &c
+	}
+
+	return nil
+}
+
+// cachedCount 返回未过期的token及ticket数量
+func (m *Manager) cachedCount() (int, int) {
+	m.Lock()
+	defer m.Unlock()
+
+	now := m.now()
+	tokens, tickets := 0, 0
+	for _, v := range m.tokens {
+		if v.expireAt.After(now) {
+			tokens++
+		}
+	}
+	for _, v := range m.tickets {
+		if v.expireAt.After(now) {
+			tickets++
 		}
+	}
+
+	return tokens, tickets
+}
+
+// Load 从存储加载未过期的token和ticket
+func (m *Manager) Load() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.storage == nil {
+		return nil
+	}
 
-		common.Logger.Printf("iterate token,appId=%s,token=%s,expireAt=%s", key.String(), value.Get("token").String(), expireAt.String())
+	snapshot, err := m.storage.Load()
+	if err != nil {
+		common.Logger.Error("load data fail", "storage", m.storage.Name(), "err", err)
+		return err
+	}
 
-		wx.tokens[key.String()] = &WValues{
-			expireAt: expireAt,
-			value:    value.Get("token").String(),
+	for appId, v := range snapshot.Tokens {
+		if v.expireAt.Before(m.now()) {
+			continue
 		}
 
-		return true
-	})
+		common.RegisterSecret(v.value)
+		common.Logger.Debug("iterate token", "appId", appId, "token", v.value, "expireAt", v.expireAt.String())
+
+		m.tokens[appId] = v
+	}
 
-	tickets := jsonResult.Get("tickets")
-	tickets.ForEach(func(key, value gjson.Result) bool {
-		expireAt := time.Unix(value.Get("expireAt").Int(), 0)
-		if expireAt.Before(time.Now()) {
-			return true
+	for appId, v := range snapshot.Tickets {
+		if v.expireAt.Before(m.now()) {
+			continue
 		}
 
-		common.Logger.Printf("iterate ticket,appId=%s,ticket=%s,expireAt=%s", key.String(), value.Get("ticket").String(), expireAt.String())
+		common.RegisterSecret(v.value)
+		common.Logger.Debug("iterate ticket", "appId", appId, "ticket", v.value, "expireAt", v.expireAt.String())
 
-		wx.tickets[key.String()] = &WValues{
-			expireAt: expireAt,
-			value:    value.Get("ticket").String(),
+		m.tickets[appId] = v
+	}
+
+	return nil
+}
+
+// snapshot 返回未过期值的快照
+func (m *Manager) snapshot() *Snapshot {
+	m.Lock()
+	defer m.Unlock()
+
+	snapshot := newSnapshot()
+	for k, v := range m.tokens {
+		if v.expireAt.After(m.now()) {
+			snapshot.Tokens[k] = v
+		}
+	}
+	for k, v := range m.tickets {
+		if v.expireAt.After(m.now()) {
+			snapshot.Tickets[k] = v
 		}
+	}
 
-		return true
-	})
-}
-
-func (w *Weixin) save() {
-	buffer := new(bytes.Buffer)
-	jWriter := jsonwriter.New(buffer)
-	jWriter.RootObject(func() {
-		jWriter.KeyValue("time", time.Now().Unix())
-		jWriter.Object("tokens", func() {
-			for k, v := range w.tokens {
-				if v.expireAt.Before(time.Now()) {
-					continue
-				}
-				jWriter.Object(k, func() {
-					jWriter.KeyValue("expireAt", v.expireAt.Unix())
-					jWriter.KeyValue("token", v.value)
-				})
-			}
-		})
-		jWriter.Object("tickets", func() {
-			for k, v := range w.tickets {
-				if v.expireAt.Before(time.Now()) {
-					continue
-				}
-				jWriter.Object(k, func() {
-					jWriter.KeyValue("expireAt", v.expireAt.Unix())
-					jWriter.KeyValue("ticket", v.value)
-				})
-			}
-		})
-	})
+	return snapshot
+}
+
+// Save 不同公众号刷新后可能同时保存 按顺序写入存储
+func (m *Manager) Save() {
+	//集群模式下只由刷新实例publish写入共享存储 避免用本地旧值覆盖或删除其他实例的值
+	if m.storage == nil || m.cluster != nil {
+		return
+	}
+
+	m.saving.Lock()
+	defer m.saving.Unlock()
+
+	snapshot := m.snapshot()
 
-	err := os.WriteFile(common.Config.DataFile, buffer.Bytes(), 0644)
+	startAt := time.Now()
+	err := m.storage.Save(snapshot)
+	observeSave(m.storage.Name(), startAt, err)
 	if err == nil {
-		common.Logger.Print("save data success")
+		common.Logger.Debug("save data success", "storage", m.storage.Name())
 	} else {
-		common.Logger.Print(err)
+		common.Logger.Error("save data fail", "storage", m.storage.Name(), "err", err)
 	}
 }
@@ -28,7 +28,7 @@ func main() {
 			return nil
 		}
 
-		common.Logger.Printf("run with config file %s", configFile)
+		common.Logger.Info("run with config file", "config", configFile)
 
 		if _, err := common.ParseConfig(configFile); err != nil {
 			return err
@@ -39,6 +39,6 @@ func main() {
 
 	err := app.Run(os.Args)
 	if err != nil {
-		common.Logger.Print(err)
+		common.Logger.Error(err.Error())
 	}
 }
@@ -0,0 +1,289 @@
+// Code generated by protoc-gen-go-grpc. DO NOT EDIT.
+// versions:
+// - protoc-gen-go-grpc v1.3.0
+// - protoc             (unknown)
+// source: pb/weixin.proto
+
+package pb
+
+import (
+	context "context"
+	grpc "google.golang.org/grpc"
+	codes "google.golang.org/grpc/codes"
+	status "google.golang.org/grpc/status"
+)
+
+// This is a compile-time assertion to ensure that this generated file
+// is compatible with the grpc package it is being compiled against.
+// Requires gRPC-Go v1.32.0 or later.
+const _ = grpc.SupportPackageIsVersion7
+
+const (
+	Weixin_GetToken_FullMethodName     = "/weixin.v1.Weixin/GetToken"
+	Weixin_GetTicket_FullMethodName    = "/weixin.v1.Weixin/GetTicket"
+	Weixin_Sign_FullMethodName         = "/weixin.v1.Weixin/Sign"
+	Weixin_ListAccounts_FullMethodName = "/weixin.v1.Weixin/ListAccounts"
+	Weixin_WatchRefresh_FullMethodName = "/weixin.v1.Weixin/WatchRefresh"
+)
+
+// WeixinClient is the client API for Weixin service.
+//
+// For semantics around ctx use and closing/ending streaming RPCs, please refer to https://pkg.go.dev/google.golang.org/grpc/?tab=doc#ClientConn.NewStream.
+type WeixinClient interface {
+	GetToken(ctx context.Context, in *GetTokenRequest, opts ...grpc.CallOption) (*Value, error)
+	GetTicket(ctx context.Context, in *GetTicketRequest, opts ...grpc.CallOption) (*Value, error)
+	// Sign 使用jsapi ticket生成JS-SDK签名
+	Sign(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error)
+	ListAccounts(ctx context.Context, in *ListAccountsRequest, opts ...grpc.CallOption) (*ListAccountsResponse, error)
+	// WatchRefresh token或ticket被替换时推送新值 sections为空时推送所有section
+	WatchRefresh(ctx context.Context, in *WatchRefreshRequest, opts ...grpc.CallOption) (Weixin_WatchRefreshClient, error)
+}
+
+type weixinClient struct {
+	cc grpc.ClientConnInterface
+}
+
+func NewWeixinClient(cc grpc.ClientConnInterface) WeixinClient {
+	return &weixinClient{cc}
+}
+
+func (c *weixinClient) GetToken(ctx context.Context, in *GetTokenRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Weixin_GetToken_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weixinClient) GetTicket(ctx context.Context, in *GetTicketRequest, opts ...grpc.CallOption) (*Value, error) {
+	out := new(Value)
+	err := c.cc.Invoke(ctx, Weixin_GetTicket_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weixinClient) Sign(ctx context.Context, in *SignRequest, opts ...grpc.CallOption) (*SignResponse, error) {
+	out := new(SignResponse)
+	err := c.cc.Invoke(ctx, Weixin_Sign_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weixinClient) ListAccounts(ctx context.Context, in *ListAccountsRequest, opts ...grpc.CallOption) (*ListAccountsResponse, error) {
+	out := new(ListAccountsResponse)
+	err := c.cc.Invoke(ctx, Weixin_ListAccounts_FullMethodName, in, out, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+func (c *weixinClient) WatchRefresh(ctx context.Context, in *WatchRefreshRequest, opts ...grpc.CallOption) (Weixin_WatchRefreshClient, error) {
+	stream, err := c.cc.NewStream(ctx, &Weixin_ServiceDesc.Streams[0], Weixin_WatchRefresh_FullMethodName, opts...)
+	if err != nil {
+		return nil, err
+	}
+	x := &weixinWatchRefreshClient{stream}
+	if err := x.ClientStream.SendMsg(in); err != nil {
+		return nil, err
+	}
+	if err := x.ClientStream.CloseSend(); err != nil {
+		return nil, err
+	}
+	return x, nil
+}
+
+type Weixin_WatchRefreshClient interface {
+	Recv() (*RefreshEvent, error)
+	grpc.ClientStream
+}
+
+type weixinWatchRefreshClient struct {
+	grpc.ClientStream
+}
+
+func (x *weixinWatchRefreshClient) Recv() (*RefreshEvent, error) {
+	m := new(RefreshEvent)
+	if err := x.ClientStream.RecvMsg(m); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// WeixinServer is the server API for Weixin service.
+// All implementations must embed UnimplementedWeixinServer
+// for forward compatibility
+type WeixinServer interface {
+	GetToken(context.Context, *GetTokenRequest) (*Value, error)
+	GetTicket(context.Context, *GetTicketRequest) (*Value, error)
+	// Sign 使用jsapi ticket生成JS-SDK签名
+	Sign(context.Context, *SignRequest) (*SignResponse, error)
+	ListAccounts(context.Context, *ListAccountsRequest) (*ListAccountsResponse, error)
+	// WatchRefresh token或ticket被替换时推送新值 sections为空时推送所有section
+	WatchRefresh(*WatchRefreshRequest, Weixin_WatchRefreshServer) error
+	mustEmbedUnimplementedWeixinServer()
+}
+
+// UnimplementedWeixinServer must be embedded to have forward compatible implementations.
+type UnimplementedWeixinServer struct {
+}
+
+func (UnimplementedWeixinServer) GetToken(context.Context, *GetTokenRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetToken not implemented")
+}
+func (UnimplementedWeixinServer) GetTicket(context.Context, *GetTicketRequest) (*Value, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method GetTicket not implemented")
+}
+func (UnimplementedWeixinServer) Sign(context.Context, *SignRequest) (*SignResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method Sign not implemented")
+}
+func (UnimplementedWeixinServer) ListAccounts(context.Context, *ListAccountsRequest) (*ListAccountsResponse, error) {
+	return nil, status.Errorf(codes.Unimplemented, "method ListAccounts not implemented")
+}
+func (UnimplementedWeixinServer) WatchRefresh(*WatchRefreshRequest, Weixin_WatchRefreshServer) error {
+	return status.Errorf(codes.Unimplemented, "method WatchRefresh not implemented")
+}
+func (UnimplementedWeixinServer) mustEmbedUnimplementedWeixinServer() {}
+
+// UnsafeWeixinServer may be embedded to opt out of forward compatibility for this service.
+// Use of this interface is not recommended, as added methods to WeixinServer will
+// result in compilation errors.
+type UnsafeWeixinServer interface {
+	mustEmbedUnimplementedWeixinServer()
+}
+
+func RegisterWeixinServer(s grpc.ServiceRegistrar, srv WeixinServer) {
+	s.RegisterService(&Weixin_ServiceDesc, srv)
+}
+
+func _Weixin_GetToken_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTokenRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeixinServer).GetToken(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Weixin_GetToken_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeixinServer).GetToken(ctx, req.(*GetTokenRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Weixin_GetTicket_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(GetTicketRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeixinServer).GetTicket(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Weixin_GetTicket_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeixinServer).GetTicket(ctx, req.(*GetTicketRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Weixin_Sign_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(SignRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeixinServer).Sign(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Weixin_Sign_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeixinServer).Sign(ctx, req.(*SignRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Weixin_ListAccounts_Handler(srv interface{}, ctx context.Context, dec func(interface{}) error, interceptor grpc.UnaryServerInterceptor) (interface{}, error) {
+	in := new(ListAccountsRequest)
+	if err := dec(in); err != nil {
+		return nil, err
+	}
+	if interceptor == nil {
+		return srv.(WeixinServer).ListAccounts(ctx, in)
+	}
+	info := &grpc.UnaryServerInfo{
+		Server:     srv,
+		FullMethod: Weixin_ListAccounts_FullMethodName,
+	}
+	handler := func(ctx context.Context, req interface{}) (interface{}, error) {
+		return srv.(WeixinServer).ListAccounts(ctx, req.(*ListAccountsRequest))
+	}
+	return interceptor(ctx, in, info, handler)
+}
+
+func _Weixin_WatchRefresh_Handler(srv interface{}, stream grpc.ServerStream) error {
+	m := new(WatchRefreshRequest)
+	if err := stream.RecvMsg(m); err != nil {
+		return err
+	}
+	return srv.(WeixinServer).WatchRefresh(m, &weixinWatchRefreshServer{stream})
+}
+
+type Weixin_WatchRefreshServer interface {
+	Send(*RefreshEvent) error
+	grpc.ServerStream
+}
+
+type weixinWatchRefreshServer struct {
+	grpc.ServerStream
+}
+
+func (x *weixinWatchRefreshServer) Send(m *RefreshEvent) error {
+	return x.ServerStream.SendMsg(m)
+}
+
+// Weixin_ServiceDesc is the grpc.ServiceDesc for Weixin service.
+// It's only intended for direct use with grpc.RegisterService,
+// and not to be introspected or modified (even as a copy)
+var Weixin_ServiceDesc = grpc.ServiceDesc{
+	ServiceName: "weixin.v1.Weixin",
+	HandlerType: (*WeixinServer)(nil),
+	Methods: []grpc.MethodDesc{
+		{
+			MethodName: "GetToken",
+			Handler:    _Weixin_GetToken_Handler,
+		},
+		{
+			MethodName: "GetTicket",
+			Handler:    _Weixin_GetTicket_Handler,
+		},
+		{
+			MethodName: "Sign",
+			Handler:    _Weixin_Sign_Handler,
+		},
+		{
+			MethodName: "ListAccounts",
+			Handler:    _Weixin_ListAccounts_Handler,
+		},
+	},
+	Streams: []grpc.StreamDesc{
+		{
+			StreamName:    "WatchRefresh",
+			Handler:       _Weixin_WatchRefresh_Handler,
+			ServerStreams: true,
+		},
+	},
+	Metadata: "pb/weixin.proto",
+}
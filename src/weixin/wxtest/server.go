@@ -0,0 +1,313 @@
+// Package wxtest 进程内模拟的微信公众号及企业微信token,ticket接口 用于集成测试
+//
+//	fake := wxtest.NewServer()
+//	defer fake.Close()
+//	fake.AddAccount("wx123", "secret")
+//	fake.Push(wxtest.Token, wxtest.Fail(wxtest.ErrApiLimit))
+//	m, _ := core.NewManager(core.ManagerConfig{Accounts: ..., HTTPClient: fake.Client()})
+//
+// Client返回的http.Client把api.weixin.qq.com及qyapi.weixin.qq.com的请求转发到模拟服务
+package wxtest
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"time"
+)
+
+// 接口名称 用于Push及Requests
+const (
+	Token    = "token"
+	Ticket   = "ticket"
+	QyToken  = "qy_token"
+	QyTicket = "qy_ticket"
+)
+
+// 常见的微信接口错误
+var (
+	ErrSystemBusy   = Error{ErrCode: -1, ErrMsg: "system error"}
+	ErrInvalidToken = Error{ErrCode: 40001, ErrMsg: "invalid credential, access_token is invalid or not latest"}
+	ErrInvalidAppId = Error{ErrCode: 40013, ErrMsg: "invalid appid"}
+	ErrSecret       = Error{ErrCode: 40125, ErrMsg: "invalid appsecret"}
+	ErrIPWhitelist  = Error{ErrCode: 40164, ErrMsg: "invalid ip 10.0.0.1 ipv6 ::ffff:10.0.0.1, not in whitelist"}
+	ErrApiLimit     = Error{ErrCode: 45009, ErrMsg: "reach max api daily quota limit"}
+	ErrFreqLimit    = Error{ErrCode: 45011, ErrMsg: "api minute-quota reach limit  mustslower  retry next minute"}
+)
+
+// Error 微信接口返回的errcode及errmsg
+type Error struct {
+	ErrCode int
+	ErrMsg  string
+}
+
+// Behavior 一次请求的处理方式 零值表示正常返回
+type Behavior struct {
+	// Error 非零时返回该错误
+	Error Error
+	// Delay 返回前等待 超过客户端超时时间即模拟超时
+	Delay time.Duration
+	// ExpiresIn 非零时覆盖默认有效期
+	ExpiresIn int
+	// Body 非空时原样返回 用于模拟异常响应
+	Body string
+}
+
+func Fail(e Error) Behavior {
+	return Behavior{Error: e}
+}
+
+func Timeout(d time.Duration) Behavior {
+	return Behavior{Delay: d}
+}
+
+func Expires(seconds int) Behavior {
+	return Behavior{ExpiresIn: seconds}
+}
+
+type account struct {
+	secret string
+	token  string
+}
+
+type Server struct {
+	*httptest.Server
+
+	mu        sync.Mutex
+	seq       int
+	expiresIn int
+	accounts  map[string]*account
+	scripts   map[string][]Behavior
+	requests  map[string]int
+}
+
+func NewServer() *Server {
+	s := &Server{
+		expiresIn: 7200,
+		accounts:  make(map[string]*account),
+		scripts:   make(map[string][]Behavior),
+		requests:  make(map[string]int),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/cgi-bin/token", s.handle(Token, s.token))
+	mux.HandleFunc("/cgi-bin/ticket/getticket", s.handle(Ticket, s.ticket))
+	mux.HandleFunc("/qy/cgi-bin/gettoken", s.handle(QyToken, s.qyToken))
+	mux.HandleFunc("/qy/cgi-bin/get_jsapi_ticket", s.handle(QyTicket, s.ticket))
+
+	s.Server = httptest.NewServer(mux)
+
+	return s
+}
+
+// Client 把微信接口请求转发到模拟服务
+func (s *Server) Client() *http.Client {
+	return &http.Client{Transport: &rewriteTransport{host: s.Listener.Addr().String()}}
+}
+
+type rewriteTransport struct {
+	host string
+}
+
+func (t *rewriteTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	r := req.Clone(req.Context())
+	r.URL.Scheme = "http"
+	r.URL.Host = t.host
+	r.Host = t.host
+	if req.URL.Host == "qyapi.weixin.qq.com" {
+		r.URL.Path = "/qy" + r.URL.Path
+	}
+
+	return http.DefaultTransport.RoundTrip(r)
+}
+
+// AddAccount 公众号和企业微信共用 企业微信appId为corpid
+func (s *Server) AddAccount(appId, secret string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.accounts[appId] = &account{secret: secret}
+}
+
+// SetExpiresIn 修改默认有效期(秒) 默认7200
+func (s *Server) SetExpiresIn(seconds int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiresIn = seconds
+}
+
+// Push 追加endpoint后续请求的处理方式 按顺序各使用一次 用完后恢复正常
+func (s *Server) Push(endpoint string, behaviors ...Behavior) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.scripts[endpoint] = append(s.scripts[endpoint], behaviors...)
+}
+
+// Requests 返回endpoint收到的请求数
+func (s *Server) Requests(endpoint string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.requests[endpoint]
+}
+
+// CurrentToken 返回appId最近签发的token 之前签发的token已失效
+func (s *Server) CurrentToken(appId string) string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.accounts[appId]; ok {
+		return a.token
+	}
+	return ""
+}
+
+// Revoke 使appId已签发的token失效 之后的ticket请求返回40001
+func (s *Server) Revoke(appId string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if a, ok := s.accounts[appId]; ok {
+		a.token = ""
+	}
+}
+
+// Reset 清除账号、脚本及请求计数
+func (s *Server) Reset() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.expiresIn = 7200
+	s.accounts = make(map[string]*account)
+	s.scripts = make(map[string][]Behavior)
+	s.requests = make(map[string]int)
+}
+
+func (s *Server) next(endpoint string) Behavior {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.requests[endpoint]++
+
+	script := s.scripts[endpoint]
+	if len(script) == 0 {
+		return Behavior{}
+	}
+	s.scripts[endpoint] = script[1:]
+
+	return script[0]
+}
+
+func (s *Server) handle(endpoint string, fn func(r *http.Request, b Behavior) interface{}) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		b := s.next(endpoint)
+
+		if b.Delay > 0 {
+			select {
+			case <-time.After(b.Delay):
+			case <-r.Context().Done():
+				return
+			}
+		}
+
+		w.Header().Set("Content-Type", "application/json; charset=utf-8")
+
+		if len(b.Body) > 0 {
+			w.Write([]byte(b.Body))
+			return
+		}
+		if b.Error.ErrCode != 0 {
+			json.NewEncoder(w).Encode(errorBody(b.Error))
+			return
+		}
+
+		json.NewEncoder(w).Encode(fn(r, b))
+	}
+}
+
+func errorBody(e Error) map[string]interface{} {
+	return map[string]interface{}{"errcode": e.ErrCode, "errmsg": e.ErrMsg}
+}
+
+func (s *Server) lifetime(b Behavior) int {
+	if b.ExpiresIn != 0 {
+		return b.ExpiresIn
+	}
+	return s.expiresIn
+}
+
+// issue 校验appId及secret后签发新token
+func (s *Server) issue(appId, secret string, b Behavior) interface{} {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	a, ok := s.accounts[appId]
+	if !ok {
+		return errorBody(ErrInvalidAppId)
+	}
+	if a.secret != secret {
+		return errorBody(ErrSecret)
+	}
+
+	s.seq++
+	a.token = fmt.Sprintf("TOKEN_%s_%d", appId, s.seq)
+
+	return map[string]interface{}{"access_token": a.token, "expires_in": s.lifetime(b)}
+}
+
+// token https://api.weixin.qq.com/cgi-bin/token?grant_type=client_credential&appid=APPID&secret=APPSECRET
+func (s *Server) token(r *http.Request, b Behavior) interface{} {
+	q := r.URL.Query()
+	if q.Get("grant_type") != "client_credential" {
+		return errorBody(Error{ErrCode: 40002, ErrMsg: "invalid grant_type"})
+	}
+
+	return s.issue(q.Get("appid"), q.Get("secret"), b)
+}
+
+// qyToken https://qyapi.weixin.qq.com/cgi-bin/gettoken?corpid=ID&corpsecret=SECRET
+func (s *Server) qyToken(r *http.Request, b Behavior) interface{} {
+	q := r.URL.Query()
+	body := s.issue(q.Get("corpid"), q.Get("corpsecret"), b)
+	if m, ok := body.(map[string]interface{}); ok && m["access_token"] != nil {
+		m["errcode"] = 0
+		m["errmsg"] = "ok"
+	}
+
+	return body
+}
+
+// ticket 公众号及企业微信jsapi ticket 公众号支持type=wx_card
+func (s *Server) ticket(r *http.Request, b Behavior) interface{} {
+	q := r.URL.Query()
+	token := q.Get("access_token")
+
+	ticketType := q.Get("type")
+	if len(ticketType) == 0 {
+		ticketType = "jsapi"
+	}
+	if ticketType != "jsapi" && ticketType != "wx_card" {
+		return errorBody(Error{ErrCode: 40097, ErrMsg: "invalid args"})
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for appId, a := range s.accounts {
+		if len(a.token) == 0 || a.token != token {
+			continue
+		}
+
+		s.seq++
+		ticket := fmt.Sprintf("TICKET_%s_%s_%d", appId, strings.ToUpper(ticketType), s.seq)
+
+		return map[string]interface{}{"errcode": 0, "errmsg": "ok", "ticket": ticket, "expires_in": s.lifetime(b)}
+	}
+
+	return errorBody(ErrInvalidToken)
+}